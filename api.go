@@ -0,0 +1,265 @@
+package main
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "math"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+    "github.com/zenazn/goji/web"
+)
+
+const MAX_API_COUNT = 100
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+type ApiItem struct {
+    Id            int       `json:"id"`
+    Title         string    `json:"title"`
+    Link          string    `json:"link"`
+    CanonicalLink string    `json:"canonicalLink"`
+    FeedTitle     string    `json:"feedTitle"`
+    FeedLink      string    `json:"feedLink"`
+    ImageLink     string    `json:"imageLink"`
+    Content       string    `json:"content"`
+    Category      string    `json:"category"`
+    PubDate       time.Time `json:"pubDate"`
+    OutLinkCnt    int       `json:"outlinkCount"`
+    InLinkCnt     int       `json:"inlinkCount"`
+    ClusterSize   int       `json:"clusterSize"`
+    Tags          []string  `json:"tags"`
+}
+
+type ApiList struct {
+    Items      []ApiItem `json:"items"`
+    NextCursor string    `json:"nextCursor,omitempty"`
+}
+
+type ApiCategory struct {
+    Dir      string   `json:"dir"`
+    Label    string   `json:"label"`
+    Channels []string `json:"channels"`
+}
+
+type ApiError struct {
+    Error ApiErrorBody `json:"error"`
+}
+
+type ApiErrorBody struct {
+    Status  int    `json:"status"`
+    Message string `json:"message"`
+}
+
+func NewApiItem(item Item) ApiItem {
+    return ApiItem{
+        Id:            item.Id,
+        Title:         item.Title,
+        Link:          item.Link,
+        CanonicalLink: GetItemExistsLink(item.ItemRedis),
+        FeedTitle:     item.FeedTitle,
+        FeedLink:      item.FeedLink,
+        ImageLink:     item.ImageLink,
+        Content:       item.Content,
+        Category:      item.Category,
+        PubDate:       item.PubDateTime,
+        OutLinkCnt:    item.OutLinkCnt,
+        InLinkCnt:     item.InLinkCnt,
+        ClusterSize:   item.ClusterSize,
+        Tags:          item.Tags,
+    }
+}
+
+func NewApiList(items []Item, cursor string) ApiList {
+    list := ApiList{Items: []ApiItem{}, NextCursor: cursor}
+    for _, item := range items {
+        list.Items = append(list.Items, NewApiItem(item))
+    }
+    return list
+}
+
+func WriteApiJson(w http.ResponseWriter, status int, v interface{}) {
+    w.Header().Set("Content-Type", "application/json; charset=utf-8")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(v)
+}
+
+func WriteApiError(w http.ResponseWriter, status int, message string) {
+    WriteApiJson(w, status, ApiError{ApiErrorBody{status, message}})
+}
+
+// EncodeCursor and DecodeCursor turn a position into an opaque cursor. For
+// new items the position is the score of the last item and how many items
+// with that score were already returned, so pages stay stable while new
+// items arrive. For rankings it is the snapshot version and the offset.
+func EncodeCursor(score float64, n int) string {
+    return base64.RawURLEncoding.EncodeToString([]byte(FormatScore(score) + "_" + strconv.Itoa(n)))
+}
+
+func DecodeCursor(cursor string) (float64, int, error) {
+    b, err := base64.RawURLEncoding.DecodeString(cursor)
+    if err != nil {
+        return 0, 0, ErrInvalidCursor
+    }
+    parts := strings.SplitN(string(b), "_", 2)
+    if len(parts) != 2 {
+        return 0, 0, ErrInvalidCursor
+    }
+    score, err := strconv.ParseFloat(parts[0], 64)
+    if err != nil {
+        return 0, 0, ErrInvalidCursor
+    }
+    n, err := strconv.Atoi(parts[1])
+    if err != nil || n < 0 {
+        return 0, 0, ErrInvalidCursor
+    }
+    return score, n, nil
+}
+
+// GetCursorFeedItem returns up to count stories of the last itemDays days
+// older than the cursor, newest first, and the cursor of the next page.
+func (dm *DataManager) GetCursorFeedItem(category string, cursor string, count int) ([]Item, string, error) {
+    keyname := dm.GetStoryKeyname(category)
+    daymin, _ := GetDateTimeMinMax((dm.UserConfig.Site.ItemDays * -1), 0, GetDateTimeFormat())
+    max, offset := math.Inf(1), 0
+    if cursor != "" {
+        var err error
+        if max, offset, err = DecodeCursor(cursor); err != nil {
+            return nil, "", err
+        }
+    }
+    keys := dm.Store.GetIndexRange(keyname, ParseScore(daymin), max, offset, count)
+    next := ""
+    if len(keys) == count {
+        next = dm.GetNextCursor(keyname, keys, max, offset)
+    }
+    return dm.GetItems(keys), next, nil
+}
+
+// GetNextCursor returns the cursor after keys, a page read from index
+// below max skipping offset items.
+func (dm *DataManager) GetNextCursor(index string, keys []string, max float64, offset int) string {
+    last, _ := dm.Store.GetIndexScore(index, keys[len(keys) - 1])
+    n := 0
+    for _, k := range keys {
+        if score, _ := dm.Store.GetIndexScore(index, k); score == last {
+            n++
+        }
+    }
+    if last == max {
+        n += offset
+    }
+    return EncodeCursor(last, n)
+}
+
+// GetCursorRankItem returns up to count items of a ranking window from the
+// cursor on. A cursor keeps reading its snapshot while it is kept.
+func (dm *DataManager) GetCursorRankItem(window string, category string, cursor string, count int) ([]Item, string, error) {
+    version, offset := dm.GetRankVersion(), 0
+    if cursor != "" {
+        v, n, err := DecodeCursor(cursor)
+        if err != nil {
+            return nil, "", err
+        }
+        offset = n
+        if dm.Store.IsKeyExists(GetRankSnapshotKeyname(int(v), window, "")) {
+            version = int(v)
+        }
+    }
+    if version == 0 {
+        return nil, "", nil
+    }
+    keys := dm.Store.GetRankRange(GetRankSnapshotKeyname(version, window, category), offset, offset + count - 1)
+    next := ""
+    if len(keys) == count {
+        next = EncodeCursor(float64(version), offset + count)
+    }
+    return dm.GetItems(keys), next, nil
+}
+
+func (cntr Controller) IsCategory(category string) bool {
+    for _, c := range GetCategories(cntr.UserConfig) {
+        if c == category {
+            return true
+        }
+    }
+    return false
+}
+
+func GetApiCount(r *http.Request, def int) int {
+    count, err := strconv.Atoi(r.URL.Query().Get("count"))
+    if err != nil || count <= 0 {
+        count = def
+    }
+    if count > MAX_API_COUNT {
+        count = MAX_API_COUNT
+    }
+    return count
+}
+
+func (cntr Controller) ApiItems(c web.C, w http.ResponseWriter, r *http.Request) {
+    category := r.URL.Query().Get("category")
+    if category != "" && !cntr.IsCategory(category) {
+        WriteApiError(w, http.StatusNotFound, "unknown category " + category)
+        return
+    }
+    items, next, err := cntr.GetCursorFeedItem(category, r.URL.Query().Get("cursor"), GetApiCount(r, cntr.UserConfig.Site.PageNewItemCount))
+    if err != nil {
+        WriteApiError(w, http.StatusBadRequest, err.Error())
+        return
+    }
+    WriteApiJson(w, http.StatusOK, NewApiList(items, next))
+}
+
+func (cntr Controller) ApiItem(c web.C, w http.ResponseWriter, r *http.Request) {
+    id, err := strconv.Atoi(c.URLParams["id"])
+    if err != nil || id <= 0 {
+        WriteApiError(w, http.StatusBadRequest, "invalid id " + c.URLParams["id"])
+        return
+    }
+    item := cntr.GetItem(REDISKEY_FEED_ITEM_PREFIX + strconv.Itoa(id))
+    if item.Id == 0 {
+        WriteApiError(w, http.StatusNotFound, "item " + strconv.Itoa(id) + " not found")
+        return
+    }
+    WriteApiJson(w, http.StatusOK, NewApiItem(item))
+}
+
+func (cntr Controller) ApiRankings(c web.C, w http.ResponseWriter, r *http.Request) {
+    window := c.URLParams["window"]
+    if window != RANK_WINDOW_DAYS && !IsRankWindow(window) {
+        WriteApiError(w, http.StatusNotFound, "unknown window " + window)
+        return
+    }
+    category := r.URL.Query().Get("category")
+    if category != "" && !cntr.IsCategory(category) {
+        WriteApiError(w, http.StatusNotFound, "unknown category " + category)
+        return
+    }
+    items, next, err := cntr.GetCursorRankItem(window, category, r.URL.Query().Get("cursor"), GetApiCount(r, cntr.UserConfig.Site.PageRankItemCount))
+    if err != nil {
+        WriteApiError(w, http.StatusBadRequest, err.Error())
+        return
+    }
+    WriteApiJson(w, http.StatusOK, NewApiList(items, next))
+}
+
+func (cntr Controller) ApiCategories(c web.C, w http.ResponseWriter, r *http.Request) {
+    result := []ApiCategory{}
+    for _, category := range cntr.UserConfig.Feed.Category {
+        channels := []string{}
+        for _, v := range cntr.UserConfig.Feed.Channel {
+            if v.Category == category.Dir {
+                channels = append(channels, v.Url)
+            }
+        }
+        result = append(result, ApiCategory{category.Dir, category.Label, channels})
+    }
+    WriteApiJson(w, http.StatusOK, result)
+}
+
+func (cntr Controller) ApiNotFound(c web.C, w http.ResponseWriter, r *http.Request) {
+    WriteApiError(w, http.StatusNotFound, "not found")
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+    "github.com/PuerkitoBio/goquery"
+)
+
+var defaultStripParams = []string{"utm_*", "fbclid", "gclid", "yclid", "mc_cid", "mc_eid", "_ga"}
+var defaultMobileSubdomains = []string{"m", "sp", "mobile", "amp"}
+
+// Canonicalizer maps the many spellings of an article URL to one canonical
+// form used for duplicate detection.
+type Canonicalizer struct {
+    Disable          bool
+    StripParams      []string
+    Scheme           string
+    MobileSubdomains []string
+    ResolveCanonical bool
+    Client           *http.Client
+}
+
+func NewCanonicalizer(conf ConfigCanonical, timeout int) *Canonicalizer {
+    c := &Canonicalizer{
+        Disable:          conf.Disable,
+        StripParams:      conf.StripParams,
+        Scheme:           strings.ToLower(conf.Scheme),
+        MobileSubdomains: conf.MobileSubdomains,
+        ResolveCanonical: conf.ResolveCanonical,
+    }
+    if c.StripParams == nil {
+        c.StripParams = defaultStripParams
+    }
+    if c.MobileSubdomains == nil {
+        c.MobileSubdomains = defaultMobileSubdomains
+    }
+    if c.Scheme == "" {
+        c.Scheme = "https"
+    }
+    if timeout <= 0 {
+        timeout = DEFAULT_FETCH_TIMEOUT
+    }
+    c.Client = &http.Client{Timeout: time.Duration(timeout) * time.Second}
+    return c
+}
+
+// Canonicalize strips tracking parameters and fragments, lowercases the
+// host, drops default ports, mobile subdomains and trailing slashes and
+// unifies the scheme. Unparsable links are returned unchanged.
+func (c *Canonicalizer) Canonicalize(link string) string {
+    link = strings.TrimSpace(link)
+    if c.Disable {
+        return link
+    }
+    u, err := url.Parse(link)
+    if err != nil || u.Host == "" {
+        return link
+    }
+    u.Scheme = strings.ToLower(u.Scheme)
+    if u.Scheme == "http" || u.Scheme == "https" {
+        u.Scheme = c.Scheme
+    }
+    host := strings.ToLower(u.Host)
+    if h := strings.TrimSuffix(host, ":80"); h != host {
+        host = h
+    } else {
+        host = strings.TrimSuffix(host, ":443")
+    }
+    u.Host = c.stripMobileSubdomain(host)
+    u.Fragment = ""
+    if u.Path != "/" {
+        u.Path = strings.TrimRight(u.Path, "/")
+        u.RawPath = ""
+    }
+    if u.Path == "" {
+        u.Path = "/"
+    }
+    query := u.Query()
+    for name := range query {
+        if c.isStripParam(name) {
+            query.Del(name)
+        }
+    }
+    u.RawQuery = query.Encode()
+    return u.String()
+}
+
+// Resolve looks for <link rel="canonical"> on the article page and returns
+// its canonical form, falling back to Canonicalize(link).
+func (c *Canonicalizer) Resolve(link string) string {
+    canonical := c.Canonicalize(link)
+    if c.Disable || !c.ResolveCanonical {
+        return canonical
+    }
+    response, err := c.Client.Get(link)
+    if err != nil {
+        return canonical
+    }
+    defer response.Body.Close()
+    if response.StatusCode != http.StatusOK {
+        return canonical
+    }
+    doc, err := goquery.NewDocumentFromResponse(response)
+    if err != nil {
+        return canonical
+    }
+    href, ok := doc.Find(`link[rel="canonical"]`).First().Attr("href")
+    if !ok || strings.TrimSpace(href) == "" {
+        return canonical
+    }
+    base, err := url.Parse(link)
+    if err != nil {
+        return canonical
+    }
+    ref, err := url.Parse(strings.TrimSpace(href))
+    if err != nil {
+        return canonical
+    }
+    return c.Canonicalize(base.ResolveReference(ref).String())
+}
+
+func (c *Canonicalizer) stripMobileSubdomain(host string) string {
+    labels := strings.Split(host, ".")
+    if len(labels) < 3 {
+        return host
+    }
+    for _, v := range c.MobileSubdomains {
+        if labels[0] == v {
+            return strings.Join(labels[1:], ".")
+        }
+    }
+    return host
+}
+
+func (c *Canonicalizer) isStripParam(name string) bool {
+    name = strings.ToLower(name)
+    for _, v := range c.StripParams {
+        v = strings.ToLower(v)
+        if strings.HasSuffix(v, "*") {
+            if strings.HasPrefix(name, strings.TrimSuffix(v, "*")) {
+                return true
+            }
+        } else if name == v {
+            return true
+        }
+    }
+    return false
+}
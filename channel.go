@@ -0,0 +1,169 @@
+package main
+
+import (
+    "time"
+    "github.com/Sirupsen/logrus"
+)
+
+const (
+    DEFAULT_STALE_HOURS          = 24
+    DEFAULT_QUARANTINE_THRESHOLD = 5
+    DEFAULT_QUARANTINE_INTERVAL  = 360
+)
+
+type ChannelState struct {
+    Url          string `redis:"url"            json:"url"`
+    Category     string `redis:"category"       json:"category"`
+    ETag         string `redis:"etag"           json:"etag"`
+    LastModified string `redis:"last_modified"  json:"lastModified"`
+    LastStatus   int    `redis:"last_status"    json:"lastStatus"`
+    LastError    string `redis:"last_error"     json:"lastError"`
+    LastFetch    string `redis:"last_fetch"     json:"lastFetch"`
+    LastSuccess  string `redis:"last_success"   json:"lastSuccess"`
+    Bytes        int    `redis:"bytes"          json:"bytes"`
+    EntryCount   int    `redis:"entry_count"    json:"entryCount"`
+    NewItemCount int    `redis:"new_item_count" json:"newItemCount"`
+    Failures     int    `redis:"failures"       json:"failures"`
+    Quarantine   string `redis:"quarantine"     json:"quarantine"`
+    Stale        bool   `redis:"-"              json:"stale"`
+    Quarantined  bool   `redis:"-"              json:"quarantined"`
+    NextFetch    string `redis:"-"              json:"nextFetch"`
+}
+
+func (s *ChannelState) SetError(status int, err error) error {
+    s.LastStatus = status
+    s.LastError = err.Error()
+    return err
+}
+
+// IsQuarantined reports whether the channel is still serving a quarantine.
+// Once the quarantine has passed the channel gets one more attempt.
+func (s *ChannelState) IsQuarantined(now time.Time) bool {
+    if s.Quarantine == "" {
+        return false
+    }
+    t, err := time.ParseInLocation(GetDateTimeFormat(), s.Quarantine, time.Local)
+    return err == nil && now.Before(t)
+}
+
+// SetFailure counts a consecutive failure and quarantines the channel once
+// threshold is reached. It reports whether the channel got quarantined.
+func (s *ChannelState) SetFailure(threshold int, interval time.Duration) bool {
+    s.Failures++
+    if s.Failures < threshold {
+        return false
+    }
+    s.Quarantine = time.Now().Add(interval).Format(GetDateTimeFormat())
+    return true
+}
+
+// SetRecovered resets the failure count and reports whether the channel was
+// quarantined before.
+func (s *ChannelState) SetRecovered() bool {
+    recovered := s.Quarantine != ""
+    s.Failures = 0
+    s.Quarantine = ""
+    return recovered
+}
+
+// IsStale reports whether the channel has not been fetched successfully
+// within the given number of hours.
+func (s *ChannelState) IsStale(hours int) bool {
+    if s.LastSuccess == "" {
+        return true
+    }
+    t, err := time.ParseInLocation(GetDateTimeFormat(), s.LastSuccess, time.Local)
+    if err != nil {
+        return true
+    }
+    return time.Since(t) > time.Duration(hours) * time.Hour
+}
+
+// GetNextFetch returns when the channel is due again; a channel that was
+// never fetched is due immediately.
+func (s *ChannelState) GetNextFetch(interval time.Duration) time.Time {
+    t, err := time.ParseInLocation(GetDateTimeFormat(), s.LastFetch, time.Local)
+    if err != nil {
+        return time.Now()
+    }
+    return t.Add(interval)
+}
+
+func GetChannelKeyname(url string) string {
+    return REDISKEY_FEED_CHANNEL_PREFIX + url
+}
+
+func (dm *DataManager) GetChannelState(channel Channel) ChannelState {
+    state := dm.Store.GetChannelState(channel.Url)
+    state.Url = channel.Url
+    state.Category = channel.Category
+    return state
+}
+
+func (dm *DataManager) SetChannelState(state ChannelState) {
+    dm.Store.SetChannelState(state)
+}
+
+func (dm *DataManager) SetChannelRecovered(state *ChannelState) {
+    if state.SetRecovered() {
+        dm.Logger.WithFields(SetChannelLog(*state)).Info("recover channel")
+    }
+}
+
+func (dm *DataManager) GetChannelStates(channel []Channel) []ChannelState {
+    hours := dm.UserConfig.Feed.StaleHours
+    if hours <= 0 {
+        hours = DEFAULT_STALE_HOURS
+    }
+    var result []ChannelState
+    for _, v := range channel {
+        state := dm.GetChannelState(v)
+        state.Stale = state.IsStale(hours)
+        state.Quarantined = state.IsQuarantined(time.Now())
+        state.NextFetch = state.GetNextFetch(GetChannelInterval(dm.UserConfig, v)).Format(GetDateTimeFormat())
+        result = append(result, state)
+    }
+    return result
+}
+
+// GetDueChannels returns the channels whose poll interval has elapsed.
+// A minute of slack keeps channels fetched late in the previous run from
+// slipping a whole cycle.
+func (dm *DataManager) GetDueChannels(channel []Channel) []Channel {
+    var result []Channel
+    deadline := time.Now().Add(time.Minute)
+    for _, v := range channel {
+        state := dm.GetChannelState(v)
+        if state.IsQuarantined(deadline) {
+            continue
+        }
+        if state.GetNextFetch(GetChannelInterval(dm.UserConfig, v)).Before(deadline) {
+            result = append(result, v)
+        }
+    }
+    return result
+}
+
+func GetQuarantineThreshold(userconf *UserConfig) int {
+    if userconf.Feed.QuarantineThreshold > 0 {
+        return userconf.Feed.QuarantineThreshold
+    }
+    return DEFAULT_QUARANTINE_THRESHOLD
+}
+
+func GetQuarantineInterval(userconf *UserConfig) time.Duration {
+    interval := userconf.Feed.QuarantineInterval
+    if interval <= 0 {
+        interval = DEFAULT_QUARANTINE_INTERVAL
+    }
+    return time.Duration(interval) * time.Minute
+}
+
+func SetChannelLog(state ChannelState) logrus.Fields {
+    return logrus.Fields{
+            "category": "feed",
+            "url": state.Url,
+            "failures": state.Failures,
+            "quarantine": state.Quarantine,
+        }
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/sha1"
+    "encoding/hex"
+    "net"
+    "net/http"
+    "strings"
+    "time"
+)
+
+const (
+    COOKIE_VISITOR        = "colle_visitor"
+    COOKIE_VISITOR_MAXAGE = 365 * 24 * 60 * 60
+)
+
+// GetVisitorId identifies the visitor of a click by the visitor cookie,
+// or by a hash of the client IP and User-Agent for visitors without one or
+// with a cookie whose signature does not verify, so a forged cookie cannot
+// count as a new visitor on every click. The hash also becomes the cookie
+// value, so a visitor keeps the same id once the cookie is set.
+func (f *ClickFilter) GetVisitorId(r *http.Request) (string, bool) {
+    if cookie, err := r.Cookie(COOKIE_VISITOR); err == nil {
+        parts := strings.SplitN(cookie.Value, ".", 2)
+        if len(parts) == 2 && parts[0] != "" && hmac.Equal([]byte(parts[1]), []byte(f.sign(COOKIE_VISITOR + ":" + parts[0]))) {
+            return parts[0], false
+        }
+    }
+    h := sha1.New()
+    h.Write([]byte(GetClientIp(r, f.ProxyHops) + "\n" + r.UserAgent()))
+    return hex.EncodeToString(h.Sum(nil)), true
+}
+
+// SetVisitorCookie stores visitor signed with the filter secret.
+func (f *ClickFilter) SetVisitorCookie(w http.ResponseWriter, visitor string) {
+    http.SetCookie(w, &http.Cookie{
+        Name:     COOKIE_VISITOR,
+        Value:    visitor + "." + f.sign(COOKIE_VISITOR + ":" + visitor),
+        Path:     "/",
+        MaxAge:   COOKIE_VISITOR_MAXAGE,
+        HttpOnly: true,
+    })
+}
+
+// GetClientIp returns the address of the client. Behind hops trusted
+// proxies it is the X-Forwarded-For entry the outermost one appended,
+// counted from the right, since the client can write any entries left of
+// it.
+func GetClientIp(r *http.Request, hops int) string {
+    if hops > 0 {
+        if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+            entries := strings.Split(forwarded, ",")
+            if hops > len(entries) {
+                hops = len(entries)
+            }
+            return strings.TrimSpace(entries[len(entries) - hops])
+        }
+    }
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
+
+// IsNewVisitor reports whether the visitor has not clicked the story yet
+// today. Copies of a story share the visitors of its representative.
+func (dm *DataManager) IsNewVisitor(cluster string, visitor string) bool {
+    day := time.Now().Format(GetDateFormat())
+    today, _ := time.ParseInLocation(GetDateFormat(), day, time.Local)
+    added, err := dm.Store.AddVisitor(REDISKEY_FEED_VISITOR_PREFIX + day + ":" + cluster, visitor, today.AddDate(0, 0, 2))
+    if err != nil {
+        dm.Logger.WithFields(SetUpdateLog("click")).Error(err.Error())
+        return true
+    }
+    return added
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+    "hash/fnv"
+    "math"
+    "strconv"
+    "strings"
+    "unicode"
+)
+
+const (
+    DEFAULT_CLUSTER_DISTANCE = 10
+    DEFAULT_CLUSTER_DAYS     = 2
+)
+
+// SimHash fingerprints text from its character bigrams, which works for
+// Japanese without a tokenizer. Similar texts get fingerprints with a
+// small Hamming distance.
+func SimHash(text string) uint64 {
+    var runes []rune
+    for _, r := range strings.ToLower(text) {
+        if unicode.IsLetter(r) || unicode.IsNumber(r) {
+            runes = append(runes, r)
+        }
+    }
+    var weights [64]int
+    for i := 0; i < len(runes); i++ {
+        end := i + 2
+        if end > len(runes) {
+            if i > 0 {
+                break
+            }
+            end = len(runes)
+        }
+        h := fnv.New64a()
+        h.Write([]byte(string(runes[i:end])))
+        v := h.Sum64()
+        for b := uint(0); b < 64; b++ {
+            if v & (1 << b) != 0 {
+                weights[b]++
+            } else {
+                weights[b]--
+            }
+        }
+    }
+    var result uint64
+    for b := uint(0); b < 64; b++ {
+        if weights[b] > 0 {
+            result |= 1 << b
+        }
+    }
+    return result
+}
+
+func HammingDistance(a uint64, b uint64) int {
+    count := 0
+    for x := a ^ b; x != 0; x &= x - 1 {
+        count++
+    }
+    return count
+}
+
+func FormatSimHash(hash uint64) string {
+    return strconv.FormatUint(hash, 16)
+}
+
+func ParseSimHash(text string) (uint64, error) {
+    return strconv.ParseUint(text, 16, 64)
+}
+
+func IsClusterEnabled(userconf *UserConfig) bool {
+    return !userconf.Feed.Cluster.Disable
+}
+
+// GetStoryKeyname returns the time index holding one representative item
+// per story, or the plain time index when clustering is disabled or the
+// story index has not been built yet, see SetStoryIndex.
+func (dm *DataManager) GetStoryKeyname(category string) string {
+    keyname := REDISKEY_FEED_TIME
+    if IsClusterEnabled(dm.UserConfig) && dm.IsStoryIndexed() {
+        keyname = REDISKEY_FEED_STORY
+    }
+    if category != "" {
+        return keyname + ":" + category
+    }
+    return keyname
+}
+
+func (dm *DataManager) IsStoryIndexed() bool {
+    return len(dm.Store.GetIndexRange(REDISKEY_FEED_STORY, math.Inf(-1), math.Inf(1), 0, 1)) > 0
+}
+
+// SetStoryIndex builds the story index on the first update after upgrading
+// to story clustering: while it is empty, every stored item becomes a
+// story of its own. It returns the number of stories added.
+func (dm *DataManager) SetStoryIndex() int {
+    if !IsClusterEnabled(dm.UserConfig) || dm.IsStoryIndexed() {
+        return 0
+    }
+    count := 0
+    for _, keyname := range dm.Store.GetItemKeys() {
+        item, ok := dm.Store.GetItem(keyname)
+        if ok && dm.SetStory(keyname, item) {
+            count++
+        }
+    }
+    if count > 0 {
+        dm.Logger.WithFields(SetUpdateLog("cluster")).Info("index " + strconv.Itoa(count) + " stories")
+    }
+    return count
+}
+
+// SetStory makes an item stored before story clustering a story of its own
+// and reports whether it had to.
+func (dm *DataManager) SetStory(keyname string, item ItemRedis) bool {
+    if item.Cluster != "" {
+        return false
+    }
+    if item.SimHash == "" {
+        item.SimHash = FormatSimHash(SimHash(item.Title + " " + item.Content))
+        dm.Store.SetItemField(keyname, "simhash", item.SimHash)
+    }
+    dm.SetCluster(keyname, item, GetDateTimeScore(GetFeedDateTime(item.PubDate)))
+    return true
+}
+
+// GetCluster returns the representative item of the closest recent story
+// within the configured distance, or "" when the item starts a new story.
+func (dm *DataManager) GetCluster(hash uint64) string {
+    distance := dm.UserConfig.Feed.Cluster.Distance
+    if distance <= 0 {
+        distance = DEFAULT_CLUSTER_DISTANCE
+    }
+    days := dm.UserConfig.Feed.Cluster.Days
+    if days <= 0 {
+        days = DEFAULT_CLUSTER_DAYS
+    }
+    daymin, daymax := GetDateTimeMinMax(days * -1, 1, GetDateTimeFormat())
+    keys := dm.Store.GetIndexRange(REDISKEY_FEED_STORY, ParseScore(daymin), ParseScore(daymax), 0, -1)
+    if len(keys) == 0 {
+        return ""
+    }
+    hashes := dm.Store.GetItemsField(keys, "simhash")
+    result := ""
+    best := distance + 1
+    for i, v := range hashes {
+        h, err := ParseSimHash(v)
+        if err != nil {
+            continue
+        }
+        if d := HammingDistance(hash, h); d < best {
+            result = keys[i]
+            best = d
+        }
+    }
+    return result
+}
+
+// SetCluster adds a stored item to its story. An item without a cluster
+// becomes the representative of a new story and enters the story indexes.
+func (dm *DataManager) SetCluster(itemkeyname string, i ItemRedis, score float64) {
+    cluster := i.Cluster
+    if cluster == "" {
+        cluster = itemkeyname
+        dm.Store.SetItemField(itemkeyname, "cluster", cluster)
+        dm.Store.AddIndex(REDISKEY_FEED_STORY, score, itemkeyname)
+        if len(i.Category) > 0 {
+            dm.Store.AddIndex(REDISKEY_FEED_STORY + ":" + i.Category, score, itemkeyname)
+        }
+    }
+    dm.Store.IncrCounter(REDISKEY_FEED_CLUSTER_SIZE_PREFIX + cluster, 1)
+}
+
+// GetClusterKeyname returns the representative item of the story the item
+// belongs to, so clicks on any copy count for the whole story.
+func (dm *DataManager) GetClusterKeyname(keyname string) string {
+    cluster := dm.Store.GetItemsField([]string{keyname}, "cluster")[0]
+    if cluster == "" {
+        return keyname
+    }
+    return cluster
+}
+
+func (dm *DataManager) GetClusterSize(keyname string) int {
+    return dm.Store.GetCounter(REDISKEY_FEED_CLUSTER_SIZE_PREFIX + keyname)
+}
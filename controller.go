@@ -10,19 +10,56 @@ import (
 
 type Controller struct {
     *DataManager
+    Scheduler *Scheduler
+    Filter    *ClickFilter
 }
 
-func NewController(dm *DataManager) *Controller {
-    return &Controller{dm}
+func NewController(dm *DataManager, scheduler *Scheduler) *Controller {
+    return &Controller{dm, scheduler, NewClickFilter(dm.UserConfig)}
+}
+
+// IsClickAllowed runs the click filter and logs rejected clicks.
+func (cntr Controller) IsClickAllowed(r *http.Request, kind string, id string) bool {
+    err := cntr.Filter.Check(r, kind, id)
+    if err != nil {
+        fields := SetClickLog(r, kind, id, cntr.Filter.ProxyHops)
+        fields["reason"] = err.Error()
+        cntr.Logger.WithFields(fields).Warn("reject click")
+    }
+    return err == nil
 }
 
 func (cntr Controller) ApiOutLink(c web.C, w http.ResponseWriter, r *http.Request) {
     keyname := REDISKEY_FEED_ITEM_PREFIX + c.URLParams["id"]
+    if !cntr.IsClickAllowed(r, CLICK_OUTLINK, c.URLParams["id"]) {
+        WriteApiError(w, http.StatusForbidden, "click rejected")
+        return
+    }
     if cntr.IsKeyExists(keyname) {
-        cntr.SetOutLinkIncrement(keyname)
+        visitor, isnew := cntr.Filter.GetVisitorId(r)
+        if isnew {
+            cntr.Filter.SetVisitorCookie(w, visitor)
+        }
+        cntr.SetOutLinkIncrement(keyname, visitor)
     }
 }
 
+func (cntr Controller) ApiChannels(c web.C, w http.ResponseWriter, r *http.Request) {
+    WriteApiJson(w, http.StatusOK, cntr.GetChannelStates(cntr.UserConfig.Feed.Channel))
+}
+
+func (cntr Controller) ApiReferrals(c web.C, w http.ResponseWriter, r *http.Request) {
+    days, err := strconv.Atoi(r.URL.Query().Get("days"))
+    if err != nil || days <= 0 {
+        days = cntr.UserConfig.Site.ItemDays
+    }
+    WriteApiJson(w, http.StatusOK, cntr.GetReferralStats(days))
+}
+
+func (cntr Controller) ApiSchedule(c web.C, w http.ResponseWriter, r *http.Request) {
+    WriteApiJson(w, http.StatusOK, cntr.Scheduler.Jobs())
+}
+
 func (cntr Controller) Root(c web.C, w http.ResponseWriter, r *http.Request) {
     tpl, err := pongo2.FromFile("main.j2")
     if err != nil {
@@ -34,13 +71,33 @@ func (cntr Controller) Root(c web.C, w http.ResponseWriter, r *http.Request) {
         pagenum = 1;
     }
     reqid := r.URL.Query().Get("id")
-    if cntr.IsKeyExists(REDISKEY_FEED_ITEM_PREFIX + reqid) {
-        cntr.SetInLinkIncrement(REDISKEY_FEED_ITEM_PREFIX + reqid)
+    if cntr.IsKeyExists(REDISKEY_FEED_ITEM_PREFIX + reqid) && cntr.IsClickAllowed(r, CLICK_INLINK, reqid) {
+        cntr.SetInLinkIncrement(REDISKEY_FEED_ITEM_PREFIX + reqid, r.Referer())
     }
     category := c.URLParams["category"]
     items := cntr.GetPageFeedItem(pagenum, category, cntr.UserConfig.Site.ItemDays, cntr.UserConfig.Site.PageNewItemCount)
-    rankitems := cntr.GetPageFeedRankItem(pagenum, category, cntr.UserConfig.Site.ItemDays, cntr.UserConfig.Site.PageRankItemCount)
-    tpl.ExecuteWriter(pongo2.Context{"items": items, "rankitems": rankitems, "p": pagenum, "reqid": reqid, "category": category}, w)
+    rankitems := cntr.GetPageFeedRankItem(pagenum, RANK_WINDOW_DAYS, category, cntr.UserConfig.Site.PageRankItemCount)
+    tpl.ExecuteWriter(pongo2.Context{"items": items, "rankitems": rankitems, "p": pagenum, "reqid": reqid, "category": category, "windows": RANK_WINDOWS, "token": cntr.Filter.GetTokenFunc(r)}, w)
+}
+
+func (cntr Controller) Rank(c web.C, w http.ResponseWriter, r *http.Request) {
+    window := c.URLParams["window"]
+    if !IsRankWindow(window) {
+        http.NotFound(w, r)
+        return
+    }
+    tpl, err := pongo2.FromFile("main.j2")
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    pagenum, err := strconv.Atoi(r.URL.Query().Get("p"))
+    if err != nil {
+        pagenum = 1;
+    }
+    category := c.URLParams["category"]
+    rankitems := cntr.GetPageFeedRankItem(pagenum, window, category, cntr.UserConfig.Site.PageRankItemCount)
+    tpl.ExecuteWriter(pongo2.Context{"rankitems": rankitems, "p": pagenum, "category": category, "window": window, "windows": RANK_WINDOWS, "token": cntr.Filter.GetTokenFunc(r)}, w)
 }
 
 func (cntr Controller) NewFeed(c web.C, w http.ResponseWriter, r *http.Request) {
@@ -53,13 +110,6 @@ func (cntr Controller) NewFeed(c web.C, w http.ResponseWriter, r *http.Request)
     tpl.ExecuteWriter(pongo2.Context{"items": items}, w)
 }
 
-func GetRankDaysKeyname(days int, category string) string {
-    if category != "" {
-        return REDISKEY_FEED_RANK_DAYS_PREFIX + category + ":" + strconv.Itoa(days)
-    }
-    return REDISKEY_FEED_RANK_DAYS_PREFIX + strconv.Itoa(days)
-}
-
 func GetRandItem(items []Item) []Item {
     for i := range items {
         j := rand.Intn(i + 1)
@@ -0,0 +1,184 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "path/filepath"
+    "regexp"
+    "strings"
+    "testing"
+    "github.com/flosch/pongo2"
+    "github.com/zenazn/goji/web"
+)
+
+// NewTestController returns a controller on an in-memory store holding the
+// items of titles, rendering the templates of the repository.
+func NewTestController(t *testing.T, titles ...string) *Controller {
+    dm := NewTestDataManager(NewMemoryStore())
+    dm.SetFeedItems(Channel{Category: "news"}, NewTestFeed(titles...), nil, NewCanonicalizer(dm.UserConfig.Feed.Canonical, 0))
+    dir, _ := filepath.Abs("template")
+    if err := pongo2.DefaultSet.SetBaseDirectory(dir); err != nil {
+        t.Fatal(err)
+    }
+    pongo2.Globals.Update(pongo2.Context{"CONFIG": dm.UserConfig})
+    return NewController(dm, nil)
+}
+
+func ServeTest(handler func(web.C, http.ResponseWriter, *http.Request), method string, target string, params map[string]string) *httptest.ResponseRecorder {
+    w := httptest.NewRecorder()
+    handler(web.C{URLParams: params}, w, httptest.NewRequest(method, target, nil))
+    return w
+}
+
+func TestRoot(t *testing.T) {
+    cntr := NewTestController(t, "Tokyo stocks rise", "Rain expected in Osaka")
+    for _, params := range []map[string]string{nil, {"category": "news"}} {
+        w := ServeTest(cntr.Root, "GET", "/", params)
+        if w.Code != http.StatusOK {
+            t.Fatalf("%v: status %d: %s", params, w.Code, w.Body.String())
+        }
+        for _, title := range []string{"Tokyo stocks rise", "Rain expected in Osaka"} {
+            if !strings.Contains(w.Body.String(), title) {
+                t.Errorf("%v: page misses %q", params, title)
+            }
+        }
+    }
+}
+
+func TestApiItems(t *testing.T) {
+    cntr := NewTestController(t, "Tokyo stocks rise", "Rain expected in Osaka")
+    w := ServeTest(cntr.ApiItems, "GET", "/api/items?count=1", nil)
+    var list ApiList
+    if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+        t.Fatal(err)
+    }
+    if len(list.Items) != 1 || list.Items[0].Title != "Rain expected in Osaka" || list.NextCursor == "" {
+        t.Fatalf("first page = %+v", list)
+    }
+    w = ServeTest(cntr.ApiItems, "GET", "/api/items?count=1&cursor=" + list.NextCursor, nil)
+    list = ApiList{}
+    json.Unmarshal(w.Body.Bytes(), &list)
+    if len(list.Items) != 1 || list.Items[0].Title != "Tokyo stocks rise" {
+        t.Fatalf("second page = %+v", list)
+    }
+    if w := ServeTest(cntr.ApiItems, "GET", "/api/items?category=sports", nil); w.Code != http.StatusNotFound {
+        t.Errorf("unknown category: status %d", w.Code)
+    }
+}
+
+func TestApiItem(t *testing.T) {
+    cntr := NewTestController(t, "Tokyo stocks rise")
+    w := ServeTest(cntr.ApiItem, "GET", "/api/items/1", map[string]string{"id": "1"})
+    var item ApiItem
+    if err := json.Unmarshal(w.Body.Bytes(), &item); err != nil {
+        t.Fatal(err)
+    }
+    if item.Id != 1 || item.Title != "Tokyo stocks rise" {
+        t.Errorf("item = %+v", item)
+    }
+    if w := ServeTest(cntr.ApiItem, "GET", "/api/items/2", map[string]string{"id": "2"}); w.Code != http.StatusNotFound {
+        t.Errorf("missing item: status %d", w.Code)
+    }
+}
+
+func TestApiOutLink(t *testing.T) {
+    for _, unique := range []bool{false, true} {
+        cntr := NewTestController(t, "Tokyo stocks rise")
+        cntr.UserConfig.Click.Unique = unique
+        for i := 0; i < 2; i++ {
+            w := httptest.NewRecorder()
+            r := httptest.NewRequest("POST", "/api/outlink/1", nil)
+            r.AddCookie(&http.Cookie{Name: COOKIE_VISITOR, Value: "visitor." + cntr.Filter.sign(COOKIE_VISITOR + ":visitor")})
+            cntr.ApiOutLink(web.C{URLParams: map[string]string{"id": "1"}}, w, r)
+        }
+        want := 2
+        if unique {
+            want = 1
+        }
+        if n := cntr.GetItem(REDISKEY_FEED_ITEM_PREFIX + "1").OutLinkCnt; n != want {
+            t.Errorf("unique %t: outlink count %d, want %d", unique, n, want)
+        }
+    }
+}
+
+// The token of a rendered link only counts clicks on that item by the
+// visitor the page was rendered for.
+func TestApiOutLinkToken(t *testing.T) {
+    cntr := NewTestController(t, "Tokyo stocks rise", "Rain expected in Osaka")
+    cntr.Filter.Disable = false
+    page := httptest.NewRequest("GET", "/", nil)
+    page.Header.Set("User-Agent", "Mozilla/5.0")
+    w := httptest.NewRecorder()
+    cntr.Root(web.C{}, w, page)
+    match := regexp.MustCompile(`data-id="1" data-token="([^"]+)"`).FindStringSubmatch(w.Body.String())
+    if match == nil {
+        t.Fatal("page has no token for item 1")
+    }
+    tests := []struct {
+        id        string
+        useragent string
+        want      int
+    }{
+        {"2", "Mozilla/5.0", 0},
+        {"1", "Mozilla/5.0 (other visitor)", 0},
+        {"1", "Mozilla/5.0", 1},
+    }
+    for _, test := range tests {
+        r := httptest.NewRequest("POST", "/api/outlink/" + test.id, strings.NewReader(url.Values{"token": {match[1]}}.Encode()))
+        r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+        r.Header.Set("User-Agent", test.useragent)
+        r.Header.Set("Referer", "http://example.com/")
+        cntr.ApiOutLink(web.C{URLParams: map[string]string{"id": test.id}}, httptest.NewRecorder(), r)
+        if n := cntr.GetItem(REDISKEY_FEED_ITEM_PREFIX + test.id).OutLinkCnt; n != test.want {
+            t.Errorf("item %s by %q: outlink count %d, want %d", test.id, test.useragent, n, test.want)
+        }
+    }
+}
+
+func TestGetVisitorId(t *testing.T) {
+    filter := NewClickFilter(NewTestUserConfig())
+    w := httptest.NewRecorder()
+    filter.SetVisitorCookie(w, "visitor")
+    fallback, _ := filter.GetVisitorId(httptest.NewRequest("POST", "/api/outlink/1", nil))
+    tests := []struct {
+        value string
+        want  string
+        isnew bool
+    }{
+        {w.Result().Cookies()[0].Value, "visitor", false},
+        {"forged." + strings.Repeat("0", 32), fallback, true},
+        {"visitor", fallback, true},
+    }
+    for _, test := range tests {
+        r := httptest.NewRequest("POST", "/api/outlink/1", nil)
+        r.AddCookie(&http.Cookie{Name: COOKIE_VISITOR, Value: test.value})
+        if visitor, isnew := filter.GetVisitorId(r); visitor != test.want || isnew != test.isnew {
+            t.Errorf("cookie %q: visitor %q, new %t, want %q, %t", test.value, visitor, isnew, test.want, test.isnew)
+        }
+    }
+}
+
+func TestGetClientIp(t *testing.T) {
+    tests := []struct {
+        forwarded string
+        hops      int
+        want      string
+    }{
+        {"203.0.113.9, 198.51.100.7", 0, "192.0.2.1"},
+        {"203.0.113.9, 198.51.100.7", 1, "198.51.100.7"},
+        {"203.0.113.9, 198.51.100.7", 2, "203.0.113.9"},
+        {"203.0.113.9", 3, "203.0.113.9"},
+        {"", 1, "192.0.2.1"},
+    }
+    for _, test := range tests {
+        r := httptest.NewRequest("GET", "/", nil)
+        if test.forwarded != "" {
+            r.Header.Set("X-Forwarded-For", test.forwarded)
+        }
+        if ip := GetClientIp(r, test.hops); ip != test.want {
+            t.Errorf("%q with %d hops: %q, want %q", test.forwarded, test.hops, ip, test.want)
+        }
+    }
+}
@@ -4,16 +4,15 @@ import (
     "strings"
     "fmt"
     "io/ioutil"
-    "sync"
     "strconv"
+    "os"
     "time"
-    "github.com/garyburd/redigo/redis"
     "github.com/flosch/pongo2"
     "github.com/Sirupsen/logrus"
 )
 
 type DataManager struct {
-    *redis.Pool
+    Store Store
     *UserConfig
     *logrus.Logger
     ExecDir string
@@ -27,8 +26,10 @@ type ItemRedis struct {
     ImageLink       string `redis:"image_link"`
     PubDate         string `redis:"pub_date"`
     MatchingWord    string `redis:"matching_word"`
+    MatchingWords   string `redis:"matching_words"`
     Content         string `redis:"content"`
     Link            string `redis:"link"`
+    CanonicalLink   string `redis:"canonical_link"`
     OutLinkCnt      int    `redis:"outlink_cnt"`
     InLinkCnt       int    `redis:"inlink_cnt"`
     Category        string `redis:"category"`
@@ -36,228 +37,277 @@ type ItemRedis struct {
     AffiliateItemId string `redis:"affiliate_item_id"`
     ListImage       string `redis:"list_image"`
     Images          string `redis:"images"`
+    SimHash         string `redis:"simhash"`
+    Cluster         string `redis:"cluster"`
 }
 
 type Item struct {
     ItemRedis
     PubDateTime     time.Time
     AffiliateImages []string
+    ClusterSize     int
+    Tags            []string
 }
 
 const (
-    REDISKEY_FEED_EXISTS           = "feed:exists"
-    REDISKEY_FEED_TIME             = "feed:time"
-    REDISKEY_FEED_TIME_PREFIX      = "feed:time:"
-    REDISKEY_FEED_ITEM_PREFIX      = "feed:item:"
-    REDISKEY_FEED_RANK_PREFIX      = "feed:rank:"
-    REDISKEY_FEED_RANK_DAYS_PREFIX = "feed:rank:days:"
-    REDISKEY_DICT_EXISTS           = "dict:exists"
-    REDISKEY_DICT_ITEM_PREFIX      = "dict:item:"
+    REDISKEY_FEED_ID                   = "feed:id"
+    REDISKEY_FEED_EXISTS               = "feed:exists"
+    REDISKEY_FEED_LINKS                = "feed:links"
+    REDISKEY_FEED_TIME                 = "feed:time"
+    REDISKEY_FEED_TIME_PREFIX          = "feed:time:"
+    REDISKEY_FEED_ITEM_PREFIX          = "feed:item:"
+    REDISKEY_FEED_RANK_PREFIX          = "feed:rank:"
+    REDISKEY_FEED_RANK_DAYS_PREFIX     = "feed:rank:days:"
+    REDISKEY_FEED_RANK_SNAPSHOT_PREFIX = "feed:rank:snapshot:"
+    REDISKEY_FEED_SNAPSHOT_ID          = "feed:snapshot:id"
+    REDISKEY_FEED_SNAPSHOT_VERSION     = "feed:snapshot:version"
+    REDISKEY_FEED_CHANNEL_PREFIX       = "feed:channel:"
+    REDISKEY_FEED_VISITOR_PREFIX       = "feed:visitor:"
+    REDISKEY_FEED_STORY                = "feed:story"
+    REDISKEY_FEED_CLUSTER_PREFIX       = "feed:cluster:"
+    REDISKEY_FEED_CLUSTER_SIZE_PREFIX  = "feed:cluster:size:"
+    REDISKEY_SEARCH_TOKEN_PREFIX       = "search:token:"
+    REDISKEY_SEARCH_ITEM_PREFIX        = "search:item:"
+    REDISKEY_SEARCH_TEMP               = "search:tmp"
+    REDISKEY_DICT_EXISTS               = "dict:exists"
+    REDISKEY_DICT_ITEM_PREFIX          = "dict:item:"
+    REDISKEY_DICT_WORDS_PREFIX         = "dict:words:"
+    REDISKEY_DICT_ENTRY_PREFIX         = "dict:entry:"
+    REDISKEY_DICT_NAMES                = "dict:names"
 )
 
-func NewRedisPool(protocol string, server string) *redis.Pool {
-    return &redis.Pool {
-        MaxIdle: 3,
-        IdleTimeout: 240 * time.Second,
-        Dial: func() (redis.Conn, error) {
-            c, err := redis.Dial(protocol, server)
-            if err != nil {
-                return nil, err
-            }
-            return c, err
-        },
-        TestOnBorrow: func(c redis.Conn, t time.Time) error {
-            _, err := c.Do("PING")
-            return err
-        },
-    }
-}
-
 func NewDataManager(userconf *UserConfig, execdir string) *DataManager {
     loggerfilename := execdir + LOGFILE
     if len(userconf.Site.Log) > 0 {
         loggerfilename = userconf.Site.Log
     }
-    return &DataManager{NewRedisPool(userconf.Redis.Protocol, userconf.Redis.Server), userconf, NewLogger(loggerfilename), execdir}
-}
-
-// "overriding" the Get method
-func (dm *DataManager)Get() redis.Conn {
-    conn := dm.Pool.Get()
-    conn.Do("SELECT", dm.UserConfig.Redis.DatabaseNo)
-    return conn
+    store, err := NewStore(userconf, execdir)
+    if err != nil {
+        fmt.Println(err.Error())
+        os.Exit(1)
+    }
+    return &DataManager{store, userconf, NewLogger(loggerfilename), execdir}
 }
 
 func (dm *DataManager) SetFeed(channel []Channel) {
-    var dict []string
+    dm.SetStoryIndex()
+    var matcher *Matcher
     for _, v := range channel {
         if v.IsDict {
-            dict = dm.GetDict(REDISKEY_DICT_EXISTS)
+            matcher = NewMatcher(dm.GetDict(REDISKEY_DICT_EXISTS))
             break
         }
     }
-    var wg sync.WaitGroup
-    wg.Add(1)
-    go func() {
-        for _, v := range channel {
-            feed := GetFeed(v.Url).ResponseData.Feed
-            for _, entrie := range feed.Entries {
-                if !dm.IsItemExists(entrie.Link) {
-                    item := ItemRedis{}
-                    if v.IsDict {
-                        word := GetMatchingWord(entrie.Title, dict)
-                        if word == nil {
-                            continue
-                        }
-                        item.MatchingWord = word.(string)
-                        dictDetail := dm.GetDictDetail(REDISKEY_DICT_ITEM_PREFIX + word.(string))
-                        item.AffiliateURL = dictDetail.AffiliateURL
-                        item.AffiliateItemId = dictDetail.AffiliateItemId
-                        item.ListImage       = dictDetail.ListImage
-                        item.Images          = dictDetail.Images
-                    }
-                    item.FeedTitle  = feed.Title
-                    item.FeedLink   = feed.Link
-                    item.Title      = entrie.Title
-                    item.ImageLink  = GetImageLink(entrie.Content)
-                    item.PubDate    = entrie.PublishedDate
-                    item.Content    = entrie.ContentSnippet
-                    item.Link       = entrie.Link
-                    item.Category   = v.Category
-                    item.OutLinkCnt = 0
-                    item.InLinkCnt  = 0
-                    dm.SetItem(item)
+    canonicalizer := NewCanonicalizer(dm.UserConfig.Feed.Canonical, dm.UserConfig.Feed.Timeout)
+    start := time.Now()
+    summary := FetchSummary{}
+    for result := range NewFeedFetcher(dm.UserConfig.Feed).Fetch(channel, dm.GetChannelState) {
+        state := result.State
+        switch {
+            case result.Err == ErrChannelQuarantined:
+                summary.Quarantined++
+                continue
+            case result.Err == ErrFeedNotModified:
+                summary.NotModified++
+                dm.SetChannelRecovered(&state)
+            case result.Err != nil:
+                summary.Failed++
+                dm.Logger.WithFields(SetUpdateLog("feed")).Error(result.Err.Error())
+                if state.SetFailure(GetQuarantineThreshold(dm.UserConfig), GetQuarantineInterval(dm.UserConfig)) {
+                    dm.Logger.WithFields(SetChannelLog(state)).Warn("quarantine channel")
+                }
+            default:
+                summary.Success++
+                dm.SetChannelRecovered(&state)
+                if result.Feed.Skipped > 0 {
+                    dm.Logger.WithFields(SetChannelLog(state)).Warn("skip " + strconv.Itoa(result.Feed.Skipped) + " entries without a valid date")
                 }
+                count, err := dm.SetFeedItems(result.Channel, result.Feed, matcher, canonicalizer)
+                state.NewItemCount = count
+                summary.NewItems += count
+                if err != nil {
+                    dm.Logger.WithFields(SetChannelLog(state)).Warn("keep validators until all entries are stored")
+                    break
+                }
+                state.ETag = result.Feed.ETag
+                state.LastModified = result.Feed.LastModified
+        }
+        dm.SetChannelState(state)
+    }
+    dm.Logger.WithFields(summary.Fields(time.Since(start))).Info("update items")
+}
+
+// SetFeedItems stores the entries of a fetched feed that are not known yet
+// and returns how many were added, with the last error of the entries that
+// could not be stored.
+func (dm *DataManager) SetFeedItems(v Channel, feed Feed, matcher *Matcher, canonicalizer *Canonicalizer) (int, error) {
+    count := 0
+    var lasterr error
+    for _, entrie := range feed.Entries {
+        canonical := canonicalizer.Canonicalize(entrie.Link)
+        if dm.IsItemExists(entrie.Link) || dm.IsItemExists(canonical) {
+            continue
+        }
+        item := ItemRedis{}
+        if v.IsDict {
+            matches := dm.GetDictMatches(entrie.Title, matcher)
+            if len(matches) == 0 {
+                continue
+            }
+            SetDictMatches(&item, matches)
+        }
+        link := canonical
+        if canonicalizer.ResolveCanonical {
+            if link = canonicalizer.Resolve(entrie.Link); dm.IsItemExists(link) {
+                continue
             }
         }
-        wg.Done()
-    }()
-    wg.Wait()
-    dm.Logger.WithFields(SetUpdateLog("feed")).Info("update items")
+        item.FeedTitle     = feed.Title
+        item.FeedLink      = feed.Link
+        item.Title         = entrie.Title
+        item.ImageLink     = GetImageLink(entrie.Content)
+        item.PubDate       = entrie.PublishedDate
+        item.Content       = entrie.ContentSnippet
+        item.Link          = entrie.Link
+        item.CanonicalLink = link
+        item.Category      = v.Category
+        item.OutLinkCnt    = 0
+        item.InLinkCnt     = 0
+        if IsClusterEnabled(dm.UserConfig) {
+            hash := SimHash(item.Title + " " + item.Content)
+            item.SimHash = FormatSimHash(hash)
+            item.Cluster = dm.GetCluster(hash)
+        }
+        if _, err := dm.SetItem(item, canonical); err != nil {
+            dm.Logger.WithFields(SetUpdateLog("feed")).Error(err.Error())
+            lasterr = err
+            continue
+        }
+        count++
+    }
+    return count, lasterr
 }
 
 func (dm *DataManager) GetDictDetail(key string) DictItemRedis {
-    values, _ := redis.Values(dm.Get().Do("HGETALL", key))
-    dictItem := DictItemRedis{}
-    redis.ScanStruct(values, &dictItem)
-    return dictItem
+    return dm.Store.GetDictItem(strings.TrimPrefix(key, REDISKEY_DICT_ITEM_PREFIX))
 }
 
-func (dm *DataManager) SetItem(i ItemRedis) {
-    con  := dm.Get()
-    i.Id  = dm.GetNewItemId()
+// SetItem stores an item under a fresh ID. Its links and the other forms
+// of them in links are recorded in feed:exists, so later updates skip the
+// entry whichever form they see.
+func (dm *DataManager) SetItem(i ItemRedis, links ...string) (int, error) {
     time := GetFeedDateTime(i.PubDate)
-    itemkeyname := REDISKEY_FEED_ITEM_PREFIX + strconv.Itoa(i.Id)
-    con.Send("MULTI")
-    con.Send("SADD", REDISKEY_FEED_EXISTS, i.Link)
-    con.Send("ZADD", REDISKEY_FEED_TIME, time.Format(GetDateTimeFormat()), itemkeyname)
+    indexes := []string{REDISKEY_FEED_TIME}
     if len(i.Category) > 0 {
-        con.Send("ZADD", REDISKEY_FEED_TIME_PREFIX + i.Category, time.Format(GetDateTimeFormat()), itemkeyname)
+        indexes = append(indexes, REDISKEY_FEED_TIME_PREFIX + i.Category)
+    }
+    score := GetDateTimeScore(time)
+    id, err := dm.Store.AddItem(i, GetItemExistsLinks(i, links...), score, time.AddDate(0, 0, dm.UserConfig.Site.ItemExpire), indexes)
+    if err != nil {
+        return id, err
+    }
+    keyname := REDISKEY_FEED_ITEM_PREFIX + strconv.Itoa(id)
+    if i.SimHash != "" {
+        dm.SetCluster(keyname, i, score)
     }
-    con.Send("HMSET", redis.Args{itemkeyname}.AddFlat(i)...)
-    con.Send("EXPIREAT", itemkeyname, time.AddDate(0, 0, dm.UserConfig.Site.ItemExpire).Unix())
-    con.Do("EXEC")
+    dm.SetSearchItem(keyname, i, score)
+    return id, nil
 }
 
-func (dm *DataManager) SetOutLinkIncrement(keyname string) {
-    con := dm.Get()
-    con.Do("ZINCRBY", REDISKEY_FEED_RANK_PREFIX + time.Now().Format(GetDateFormat()), 1, keyname)
-    con.Do("HINCRBY", keyname, "outlink_cnt", 1)
+// GetItemExistsLink returns the link recorded in feed:exists; items stored
+// before canonicalization only have the raw link.
+func GetItemExistsLink(i ItemRedis) string {
+    if i.CanonicalLink != "" {
+        return i.CanonicalLink
+    }
+    return i.Link
 }
 
-func (dm *DataManager) SetInLinkIncrement(keyname string) {
-    con := dm.Get()
-    con.Do("HINCRBY", keyname, "inlink_cnt", 1)
+// GetItemExistsLinks returns GetItemExistsLink followed by the raw link and
+// links, without blanks and duplicates.
+func GetItemExistsLinks(i ItemRedis, links ...string) []string {
+    result := []string{GetItemExistsLink(i)}
+    for _, link := range append([]string{i.Link}, links...) {
+        found := link == ""
+        for _, v := range result {
+            found = found || v == link
+        }
+        if !found {
+            result = append(result, link)
+        }
+    }
+    return result
 }
 
-func (dm *DataManager) IsItemExists(link string) bool {
-    con := dm.Get()
-    result, err := redis.Int(con.Do("SISMEMBER", REDISKEY_FEED_EXISTS, link))
-    if err != nil {
-        fmt.Println(err)
+// SetOutLinkIncrement counts a click on an item. With click.unique the
+// badge and the rankings only count the first click of a visitor on a
+// story each day.
+func (dm *DataManager) SetOutLinkIncrement(keyname string, visitor string) {
+    cluster := dm.GetClusterKeyname(keyname)
+    if dm.UserConfig.Click.Unique && !dm.IsNewVisitor(cluster, visitor) {
+        return
     }
-    return result == 1
+    dm.Store.IncrItemField(keyname, "outlink_cnt", 1)
+    now := time.Now()
+    dm.Store.IncrRank(GetRankKeyname(RANK_STREAM_OUT, now, false), cluster, 1)
+    dm.Store.IncrRank(GetRankKeyname(RANK_STREAM_OUT, now, true), cluster, 1)
 }
 
-func (dm *DataManager) IsKeyExists(keyname string) bool {
-    con := dm.Get()
-    result, err := redis.Int(con.Do("EXISTS", keyname))
-    if err != nil {
-        fmt.Println(err)
-    }
-    return result == 1
+// SetInLinkIncrement counts a visit from a feed reader or another site for
+// the in ranking and the referral stats of the referring site.
+func (dm *DataManager) SetInLinkIncrement(keyname string, referer string) {
+    cluster := dm.GetClusterKeyname(keyname)
+    dm.Store.IncrItemField(keyname, "inlink_cnt", 1)
+    now := time.Now()
+    dm.Store.IncrRank(GetRankKeyname(RANK_STREAM_IN, now, false), cluster, 1)
+    dm.Store.IncrRank(GetRankKeyname(RANK_STREAM_IN, now, true), cluster, 1)
+    dm.Store.IncrRank(GetRankKeyname(RANK_STREAM_REFERER, now, false), GetReferralSource(referer), 1)
 }
 
-func (dm *DataManager) GetNewItemId() int {
-    con := dm.Get()
-    result, err := redis.Int(con.Do("SCARD", REDISKEY_FEED_EXISTS))
-    if err != nil {
-        fmt.Println(err)
-    }
-    return result + 1
+func (dm *DataManager) IsItemExists(link string) bool {
+    return dm.Store.IsItemExists(link)
+}
+
+func (dm *DataManager) IsKeyExists(keyname string) bool {
+    return dm.Store.IsKeyExists(keyname)
 }
 
 func (dm *DataManager) GetDict(keyname string) []string {
-    con := dm.Get()
-    result, _ := redis.Strings(con.Do("SMEMBERS", keyname))
-    return result
+    return dm.Store.GetDictWords()
 }
 
 func (dm *DataManager) GetNewFeedItem(keyname string, min string, max string, offset int, count int) []Item {
-    con := dm.Get()
-    strings, _ := redis.Strings(con.Do("ZREVRANGEBYSCORE", keyname, max, min, "limit", offset, count))
-    return dm.GetItems(strings)
+    return dm.GetItems(dm.Store.GetIndexRange(keyname, ParseScore(min), ParseScore(max), offset, count))
 }
 
 func (dm *DataManager) GetRankFeedItem(keyname string, min int, max int) []Item {
-    con := dm.Get()
-    strings, _ := redis.Strings(con.Do("ZREVRANGE", keyname, min, max))
-    return dm.GetItems(strings)
+    return dm.GetItems(dm.Store.GetRankRange(keyname, min, max))
 }
 
 func (dm *DataManager) GetItems(itemlist []string) []Item {
     var result []Item
     for _, keyname := range itemlist {
         item := dm.GetItem(keyname)
+        if item.Id == 0 {
+            continue
+        }
         result = append(result, item)
     }
     return result
 }
 
 func (dm *DataManager) GetItem(keyname string) Item {
-    con := dm.Get()
-    values, _ := redis.Values(con.Do("HGETALL", keyname))
-    itemRedis := ItemRedis{}
-    redis.ScanStruct(values, &itemRedis)
+    itemRedis, _ := dm.Store.GetItem(keyname)
     datetime, _ := time.Parse(time.RFC1123Z, itemRedis.PubDate)
     var images []string
     if itemRedis.Images != "" {
         images = strings.Split(itemRedis.Images, "\n")
     }
-    return Item{itemRedis, datetime, images}
-}
-
-func (dm *DataManager) SetRankRange(days []string, category string) {
-    con := dm.Get()
-    var args []interface{}
-    var cargs []interface{}
-    allrankkey := GetRankDaysKeyname(len(days), "")
-    categoryrankkey := GetRankDaysKeyname(len(days), category)
-    keycnt := strconv.Itoa(len(days))
-    for _, v := range append([]string{allrankkey, keycnt}, days...) {
-        args = append(args, interface{}(v))
-    }
-    con.Do("ZUNIONSTORE", args...)
-    if category != "" {
-        cargs = append(cargs, interface{}(categoryrankkey))
-        cargs = append(cargs, interface{}("2"))
-        cargs = append(cargs, interface{}(REDISKEY_FEED_TIME_PREFIX + category))
-        cargs = append(cargs, interface{}(allrankkey))
-        cargs = append(cargs, interface{}("WEIGHTS"))
-        cargs = append(cargs, interface{}("0"))
-        cargs = append(cargs, interface{}("1"))
-        con.Do("ZINTERSTORE", cargs...)
+    clustersize := 0
+    if itemRedis.Cluster != "" {
+        clustersize = dm.GetClusterSize(itemRedis.Cluster)
     }
+    return Item{itemRedis, datetime, images, clustersize, GetItemTags(itemRedis)}
 }
 
 func (dm *DataManager) WriteRssFile(filename string, pctx pongo2.Context) {
@@ -269,20 +319,22 @@ func (dm *DataManager) WriteRssFile(filename string, pctx pongo2.Context) {
 }
 
 func (dm *DataManager) GetPageFeedItem(num int, category string, days int, count int) []Item {
-    keyname := REDISKEY_FEED_TIME
-    if category != "" {
-        keyname = REDISKEY_FEED_TIME_PREFIX + category
-    }
+    keyname := dm.GetStoryKeyname(category)
     daymin, daymax := GetDateTimeMinMax((days * -1), 0, GetDateTimeFormat())
     offset := count * (num - 1)
     return dm.GetNewFeedItem(keyname, daymin, daymax, offset, count)
 }
 
-func (dm *DataManager) GetPageFeedRankItem(num int, category string, days int, count int) []Item {
-    dm.SetRankRange(GetDateTimeRange(((days -1) * -1), 0), category)
+// GetPageFeedRankItem reads the published ranking snapshot of a window and
+// never writes, so page views stay cheap; see SetRankSnapshot.
+func (dm *DataManager) GetPageFeedRankItem(num int, window string, category string, count int) []Item {
+    version := dm.GetRankVersion()
+    if version == 0 {
+        return nil
+    }
     rankmin := (num - 1) * count
     rankmax := rankmin + count - 1
-    return dm.GetRankFeedItem(GetRankDaysKeyname(days, category), rankmin, rankmax)
+    return dm.GetRankFeedItem(GetRankSnapshotKeyname(version, window, category), rankmin, rankmax)
 }
 
 func (dm *DataManager) GetCategoryItem(items []Item, category string, count int) []Item {
@@ -296,8 +348,5 @@ func (dm *DataManager) GetCategoryItem(items []Item, category string, count int)
 }
 
 func (dm *DataManager) SetData(key string) DictItemRedis {
-    values, _ := redis.Values(dm.Get().Do("HGETALL", key))
-    dictItem := DictItemRedis{}
-    redis.ScanStruct(values, &dictItem)
-    return dictItem
+    return dm.GetDictDetail(key)
 }
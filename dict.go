@@ -1,21 +1,16 @@
 package main
 
 import (
-    "sync"
-    "io/ioutil"
-    "net/http"
-    "unsafe"
-    "time"
-    "encoding/xml"
-    "net/url"
+    "encoding/json"
+    "fmt"
+    "sort"
     "strconv"
     "strings"
-    "github.com/PuerkitoBio/goquery"
-    "github.com/garyburd/redigo/redis"
-    "golang.org/x/text/encoding/japanese"
-    "golang.org/x/text/transform"
+    "sync"
 )
 
+const DEFAULT_DICT_WORKERS = 8
+
 type DictItemRedis struct {
     Advertiser      string `redis:"advertiser"`
     Dict            string `redis:"dict"`
@@ -25,102 +20,134 @@ type DictItemRedis struct {
     Images          string `redis:"images"`
 }
 
-type ResponseDMM struct {
-    XMLName    xml.Name  `xml:"response"`
-    TotalCount int       `xml:"result>total_count"`
-    Item       []ItemDMM `xml:"result>items>item"`
+// DictEntry is a word of a dictionary. Image is a picture of the word
+// found while fetching, if any.
+type DictEntry struct {
+    Word  string
+    Image string
+    Item  DictItemRedis
 }
 
-type ItemDMM struct {
-    ProductId      string      `xml:"product_id"`
-    AffiliateURL   string      `xml:"affiliateURL"`
-    ImageURL       ImageURLDMM `xml:"imageURL"`
-    SampleImageURL []string    `xml:"sampleImageURL>sample_s>image"`
+// DictProvider is a source of dictionary words, named in dict.use. Its
+// settings are the section of the same name in dict.
+type DictProvider interface {
+    Name() string
+    Configure(conf json.RawMessage) error
+    Fetch() ([]DictEntry, error)
+    // Enrich adds the affiliate data to an entry. Entries failing to be
+    // enriched are not stored.
+    Enrich(entry *DictEntry) error
 }
 
-type ImageURLDMM struct {
-    List  string `xml:"list"`
-    Small string `xml:"small"`
-    Large string `xml:"large"`
+var dictProviders = make(map[string]func() DictProvider)
+
+// RegisterDictProvider makes a provider available to dict.use, usually
+// from the init function of the file implementing it.
+func RegisterDictProvider(name string, factory func() DictProvider) {
+    dictProviders[name] = factory
 }
 
-func (dm *DataManager) SetDict(dictname string) {
-    switch dictname {
-        case "DMMR18ACT": dm.SetDictDmmR18Act(dictname)
+// UnmarshalJSON reads "use" and "score" and keeps every other section of
+// dict for the provider of that name.
+func (c *ConfigDict) UnmarshalJSON(data []byte) error {
+    var sections map[string]json.RawMessage
+    if err := json.Unmarshal(data, &sections); err != nil {
+        return err
+    }
+    c.Providers = make(map[string]json.RawMessage)
+    for name, section := range sections {
+        var err error
+        switch name {
+            case "use":
+                err = json.Unmarshal(section, &c.Use)
+            case "score":
+                err = json.Unmarshal(section, &c.Score)
+            default:
+                c.Providers[name] = section
+        }
+        if err != nil {
+            return fmt.Errorf("dict.%s: %s", name, err.Error())
+        }
+    }
+    return nil
+}
+
+func GetDictProviderNames() []string {
+    var result []string
+    for name := range dictProviders {
+        result = append(result, name)
+    }
+    sort.Strings(result)
+    return result
+}
+
+func NewDictProvider(name string, conf ConfigDict) (DictProvider, error) {
+    factory, ok := dictProviders[name]
+    if !ok {
+        return nil, fmt.Errorf("unknown dict provider %s, use one of %s", name, strings.Join(GetDictProviderNames(), ", "))
+    }
+    provider := factory()
+    if err := provider.Configure(conf.Providers[name]); err != nil {
+        return nil, fmt.Errorf("dict %s: %s", name, err.Error())
     }
+    return provider, nil
 }
 
-func (dm *DataManager) SetDictDmmR18Act(dictname string) {
-    baseurl := "http://www.dmm.co.jp/digital/videoa/-/actress/=/keyword="
-    keywords := []string{"a", "i", "u", "e", "o", "ka", "ki", "ku", "ke", "ko", "sa", "si", "su", "se", "so", "ta", "ti", "tu", "te", "to", "na", "ni", "ne", "no", "ha", "hi", "hu", "he", "ho", "ma", "mi", "mu", "me", "mo", "ya", "yu", "yo", "ra", "ri", "ru", "re", "ro", "wa"}
+// DictReplacer is implemented by providers whose Fetch returns the whole
+// dictionary or an error. Their words replace the stored words of the
+// dictionary in one step, so words removed from the source go away too.
+type DictReplacer interface {
+    ReplacesDict() bool
+}
+
+// SetDict fetches the words of a dictionary and stores them with their
+// affiliate data, enriching up to DEFAULT_DICT_WORKERS entries at once.
+func (dm *DataManager) SetDict(dictname string) {
+    provider, err := NewDictProvider(dictname, dm.UserConfig.Dict)
+    if err != nil {
+        dm.Logger.WithFields(SetUpdateLog("dict")).Error(err.Error())
+        return
+    }
+    entries, err := provider.Fetch()
+    if err != nil {
+        dm.Logger.WithFields(SetUpdateLog("dict")).Error(err.Error())
+        return
+    }
+    replacer, replace := provider.(DictReplacer)
+    replace = replace && replacer.ReplacesDict()
+    items := make(map[string]DictItemRedis)
+    var mu sync.Mutex
+    queue := make(chan DictEntry)
     var wg sync.WaitGroup
-    for _, keyword := range keywords {
+    for i := 0; i < DEFAULT_DICT_WORKERS; i++ {
         wg.Add(1)
-        go func(keyword string) {
-            for i := 1;; i++ {
-                url := baseurl + keyword + "/page=" + strconv.Itoa(i) + "/"
-                doc, err := goquery.NewDocument(url)
-                if err != nil {
-                    break
+        go func() {
+            defer wg.Done()
+            for entry := range queue {
+                if err := provider.Enrich(&entry); err != nil {
+                    continue
                 }
-                s := doc.Find(".act-box").Each(func(_ int, s *goquery.Selection) {
-                    s.Find("img").Each(func(_ int, s *goquery.Selection) {
-                        actname, _ := s.Attr("alt")
-                        actimage, _ := s.Attr("src")
-                        response, err := GetDmmAffiliate(dm.UserConfig.Dict.DMMR18ACT.ApiId, dm.UserConfig.Dict.DMMR18ACT.AffiliateId, doDmmEncoding(actname))
-                        if err != nil {
-                            return
-                        }
-                        con := dm.Get()
-                        con.Do("SADD", REDISKEY_DICT_EXISTS, actname)
-                        i := DictItemRedis{}
-                        i.Advertiser = "DMM"
-                        i.Dict = dictname
-                        if len(response.Item) > 0 {
-                            i.ListImage       = actimage
-                            i.AffiliateItemId = response.Item[0].ProductId
-                            i.AffiliateURL    = response.Item[0].AffiliateURL
-                            i.Images          = strings.Join(response.Item[0].SampleImageURL, "\n")
-                        }
-                        con.Do("HMSET", redis.Args{REDISKEY_DICT_ITEM_PREFIX + actname}.AddFlat(i)...)
-                    })
-                })
-                if len(strings.Replace(s.Text(), "\n", "", -1)) == 0 {
-                    break
+                entry.Item.Dict = provider.Name()
+                if !replace {
+                    dm.Store.AddDictItem(entry.Word, entry.Item)
+                    continue
                 }
+                mu.Lock()
+                items[entry.Word] = entry.Item
+                mu.Unlock()
             }
-            wg.Done()
-        }(keyword)
+        }()
     }
+    for _, entry := range entries {
+        queue <- entry
+    }
+    close(queue)
     wg.Wait()
-}
-
-func GetDmmAffiliate(apiId string, affiliateId string, keyword string) (ResponseDMM, error) {
-    values := url.Values{}
-    values.Add("api_id", apiId)
-    values.Add("affiliate_id", affiliateId)
-    values.Add("operation", "ItemList")
-    values.Add("version", "2.00")
-    values.Add("timestamp", time.Now().Format("2006-01-02 15:04:05"))
-    values.Add("site", "DMM.co.jp")
-    values.Add("service", "digital")
-    values.Add("floor", "videoa")
-    values.Add("hits", "1")
-    values.Add("sort", "review")
-    values.Add("keyword", keyword)
-    response, err := http.Get("http://affiliate-api.dmm.com/?" + values.Encode())
-    var r ResponseDMM
-    if err != nil {
-        return r, err
+    if replace {
+        if err := dm.Store.ReplaceDictItems(provider.Name(), items); err != nil {
+            dm.Logger.WithFields(SetUpdateLog("dict")).Error(err.Error())
+            return
+        }
+        dm.Logger.WithFields(SetUpdateLog("dict")).Info("replace " + provider.Name() + " with " + strconv.Itoa(len(items)) + " words")
     }
-    defer response.Body.Close()
-    body, err := ioutil.ReadAll(transform.NewReader(response.Body, japanese.EUCJP.NewDecoder()))
-    contents := strings.Replace(string(body), "euc-jp", "UTF-8", -1)
-    xml.Unmarshal(*(*[]byte)(unsafe.Pointer(&contents)), &r)
-    return r, err
-}
-
-func doDmmEncoding(text string) string {
-    ret, _ := ioutil.ReadAll(transform.NewReader(strings.NewReader(text), japanese.EUCJP.NewEncoder()))
-    return string(ret)
 }
@@ -0,0 +1,146 @@
+package main
+
+import (
+    "sync"
+    "io/ioutil"
+    "net/http"
+    "unsafe"
+    "time"
+    "encoding/json"
+    "encoding/xml"
+    "net/url"
+    "strconv"
+    "strings"
+    "github.com/PuerkitoBio/goquery"
+    "golang.org/x/text/encoding/japanese"
+    "golang.org/x/text/transform"
+)
+
+const DICT_DMMR18ACT = "DMMR18ACT"
+
+type DMMR18ACT struct {
+    ApiId       string `json:"apiId"`
+    AffiliateId string `json:"affiliateId"`
+}
+
+type ResponseDMM struct {
+    XMLName    xml.Name  `xml:"response"`
+    TotalCount int       `xml:"result>total_count"`
+    Item       []ItemDMM `xml:"result>items>item"`
+}
+
+type ItemDMM struct {
+    ProductId      string      `xml:"product_id"`
+    AffiliateURL   string      `xml:"affiliateURL"`
+    ImageURL       ImageURLDMM `xml:"imageURL"`
+    SampleImageURL []string    `xml:"sampleImageURL>sample_s>image"`
+}
+
+type ImageURLDMM struct {
+    List  string `xml:"list"`
+    Small string `xml:"small"`
+    Large string `xml:"large"`
+}
+
+// DmmR18ActProvider collects actress names from the DMM actress index and
+// links them to their most reviewed video through the DMM affiliate API.
+type DmmR18ActProvider struct {
+    DMMR18ACT
+}
+
+func init() {
+    RegisterDictProvider(DICT_DMMR18ACT, func() DictProvider {
+        return &DmmR18ActProvider{}
+    })
+}
+
+func (p *DmmR18ActProvider) Name() string {
+    return DICT_DMMR18ACT
+}
+
+func (p *DmmR18ActProvider) Configure(conf json.RawMessage) error {
+    if len(conf) == 0 {
+        return nil
+    }
+    return json.Unmarshal(conf, &p.DMMR18ACT)
+}
+
+func (p *DmmR18ActProvider) Fetch() ([]DictEntry, error) {
+    baseurl := "http://www.dmm.co.jp/digital/videoa/-/actress/=/keyword="
+    keywords := []string{"a", "i", "u", "e", "o", "ka", "ki", "ku", "ke", "ko", "sa", "si", "su", "se", "so", "ta", "ti", "tu", "te", "to", "na", "ni", "ne", "no", "ha", "hi", "hu", "he", "ho", "ma", "mi", "mu", "me", "mo", "ya", "yu", "yo", "ra", "ri", "ru", "re", "ro", "wa"}
+    var result []DictEntry
+    var mu sync.Mutex
+    var wg sync.WaitGroup
+    for _, keyword := range keywords {
+        wg.Add(1)
+        go func(keyword string) {
+            for i := 1;; i++ {
+                url := baseurl + keyword + "/page=" + strconv.Itoa(i) + "/"
+                doc, err := goquery.NewDocument(url)
+                if err != nil {
+                    break
+                }
+                s := doc.Find(".act-box").Each(func(_ int, s *goquery.Selection) {
+                    s.Find("img").Each(func(_ int, s *goquery.Selection) {
+                        actname, _ := s.Attr("alt")
+                        actimage, _ := s.Attr("src")
+                        mu.Lock()
+                        result = append(result, DictEntry{Word: actname, Image: actimage})
+                        mu.Unlock()
+                    })
+                })
+                if len(strings.Replace(s.Text(), "\n", "", -1)) == 0 {
+                    break
+                }
+            }
+            wg.Done()
+        }(keyword)
+    }
+    wg.Wait()
+    return result, nil
+}
+
+func (p *DmmR18ActProvider) Enrich(entry *DictEntry) error {
+    response, err := GetDmmAffiliate(p.ApiId, p.AffiliateId, doDmmEncoding(entry.Word))
+    if err != nil {
+        return err
+    }
+    entry.Item.Advertiser = "DMM"
+    if len(response.Item) > 0 {
+        entry.Item.ListImage       = entry.Image
+        entry.Item.AffiliateItemId = response.Item[0].ProductId
+        entry.Item.AffiliateURL    = response.Item[0].AffiliateURL
+        entry.Item.Images          = strings.Join(response.Item[0].SampleImageURL, "\n")
+    }
+    return nil
+}
+
+func GetDmmAffiliate(apiId string, affiliateId string, keyword string) (ResponseDMM, error) {
+    values := url.Values{}
+    values.Add("api_id", apiId)
+    values.Add("affiliate_id", affiliateId)
+    values.Add("operation", "ItemList")
+    values.Add("version", "2.00")
+    values.Add("timestamp", time.Now().Format("2006-01-02 15:04:05"))
+    values.Add("site", "DMM.co.jp")
+    values.Add("service", "digital")
+    values.Add("floor", "videoa")
+    values.Add("hits", "1")
+    values.Add("sort", "review")
+    values.Add("keyword", keyword)
+    response, err := http.Get("http://affiliate-api.dmm.com/?" + values.Encode())
+    var r ResponseDMM
+    if err != nil {
+        return r, err
+    }
+    defer response.Body.Close()
+    body, err := ioutil.ReadAll(transform.NewReader(response.Body, japanese.EUCJP.NewDecoder()))
+    contents := strings.Replace(string(body), "euc-jp", "UTF-8", -1)
+    xml.Unmarshal(*(*[]byte)(unsafe.Pointer(&contents)), &r)
+    return r, err
+}
+
+func doDmmEncoding(text string) string {
+    ret, _ := ioutil.ReadAll(transform.NewReader(strings.NewReader(text), japanese.EUCJP.NewEncoder()))
+    return string(ret)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+    "bytes"
+    "encoding/csv"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/url"
+    "path/filepath"
+    "sort"
+    "strings"
+)
+
+const (
+    DICT_LOCAL       = "LOCAL"
+    DICT_FORMAT_CSV  = "csv"
+    DICT_FORMAT_JSON = "json"
+)
+
+var DICT_LOCAL_COLUMNS = []string{"word", "advertiser", "affiliateUrl", "affiliateItemId", "listImage", "images"}
+
+type ConfigDictLocal struct {
+    Path   string `json:"path"`
+    Format string `json:"format"`
+}
+
+// DictLocalRow is an entry of a local dictionary file. In CSV files the
+// first line names the columns and images are separated by spaces.
+type DictLocalRow struct {
+    Word            string   `json:"word"`
+    Advertiser      string   `json:"advertiser"`
+    AffiliateURL    string   `json:"affiliateUrl"`
+    AffiliateItemId string   `json:"affiliateItemId"`
+    ListImage       string   `json:"listImage"`
+    Images          []string `json:"images"`
+}
+
+// DictLineError is a rejected row: a line of a CSV file or an entry of a
+// JSON file.
+type DictLineError struct {
+    Line int
+    Err  error
+}
+
+type byDictLine []DictLineError
+
+func (a byDictLine) Len() int           { return len(a) }
+func (a byDictLine) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byDictLine) Less(i, j int) bool { return a[i].Line < a[j].Line }
+
+// DictFileError collects every rejected row of a file.
+type DictFileError struct {
+    Path   string
+    Unit   string
+    Errors []DictLineError
+}
+
+func (e *DictFileError) Error() string {
+    var lines []string
+    for _, v := range e.Errors {
+        lines = append(lines, fmt.Sprintf("%s %s %d: %s", e.Path, e.Unit, v.Line, v.Err.Error()))
+    }
+    return strings.Join(lines, "\n")
+}
+
+// DictLocalProvider loads a dictionary maintained by hand from a CSV or
+// JSON file. A file with any invalid row is rejected as a whole and the
+// stored dictionary is kept; otherwise it replaces the stored one.
+type DictLocalProvider struct {
+    ConfigDictLocal
+}
+
+func init() {
+    RegisterDictProvider(DICT_LOCAL, func() DictProvider {
+        return &DictLocalProvider{}
+    })
+}
+
+func (p *DictLocalProvider) Name() string {
+    return DICT_LOCAL
+}
+
+func (p *DictLocalProvider) Configure(conf json.RawMessage) error {
+    if len(conf) > 0 {
+        if err := json.Unmarshal(conf, &p.ConfigDictLocal); err != nil {
+            return err
+        }
+    }
+    if p.Path == "" {
+        return errors.New("missing path")
+    }
+    if p.Format == "" {
+        p.Format = strings.TrimPrefix(strings.ToLower(filepath.Ext(p.Path)), ".")
+    }
+    if p.Format != DICT_FORMAT_CSV && p.Format != DICT_FORMAT_JSON {
+        return fmt.Errorf("unknown format %s, use csv or json", p.Format)
+    }
+    return nil
+}
+
+func (p *DictLocalProvider) ReplacesDict() bool {
+    return true
+}
+
+func (p *DictLocalProvider) Fetch() ([]DictEntry, error) {
+    data, err := ioutil.ReadFile(p.Path)
+    if err != nil {
+        return nil, err
+    }
+    ferr := &DictFileError{Path: p.Path, Unit: "line"}
+    var rows []DictLocalRow
+    var lines []int
+    if p.Format == DICT_FORMAT_JSON {
+        ferr.Unit = "entry"
+        rows, lines, err = ReadDictJson(data, ferr)
+    } else {
+        rows, lines, err = ReadDictCsv(data, ferr)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("%s: %s", p.Path, err.Error())
+    }
+    var result []DictEntry
+    seen := make(map[string]int)
+    for i, row := range rows {
+        if err := row.Validate(); err != nil {
+            ferr.Errors = append(ferr.Errors, DictLineError{lines[i], err})
+            continue
+        }
+        if line, ok := seen[row.Word]; ok {
+            ferr.Errors = append(ferr.Errors, DictLineError{lines[i], fmt.Errorf("duplicate word %s, first in %s %d", row.Word, ferr.Unit, line)})
+            continue
+        }
+        seen[row.Word] = lines[i]
+        result = append(result, row.Entry())
+    }
+    if len(ferr.Errors) > 0 {
+        sort.Sort(byDictLine(ferr.Errors))
+        return nil, ferr
+    }
+    return result, nil
+}
+
+// Enrich has nothing to add, the file already holds the affiliate data.
+func (p *DictLocalProvider) Enrich(entry *DictEntry) error {
+    return nil
+}
+
+// ReadDictCsv reads the rows of a CSV file and the line each starts on.
+// Rows with a wrong number of fields are added to ferr.
+func ReadDictCsv(data []byte, ferr *DictFileError) ([]DictLocalRow, []int, error) {
+    reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+    reader.FieldsPerRecord = -1
+    reader.TrimLeadingSpace = true
+    header, err := reader.Read()
+    if err != nil {
+        return nil, nil, fmt.Errorf("read header: %s", err.Error())
+    }
+    columns := make(map[string]int)
+    for i, name := range header {
+        name = strings.TrimSpace(name)
+        if !IsDictLocalColumn(name) {
+            return nil, nil, fmt.Errorf("unknown column %s, use %s", name, strings.Join(DICT_LOCAL_COLUMNS, ", "))
+        }
+        columns[name] = i
+    }
+    if _, ok := columns["word"]; !ok {
+        return nil, nil, errors.New("missing column word")
+    }
+    var rows []DictLocalRow
+    var lines []int
+    for {
+        record, err := reader.Read()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, nil, err
+        }
+        line, _ := reader.FieldPos(0)
+        if len(record) != len(header) {
+            ferr.Errors = append(ferr.Errors, DictLineError{line, fmt.Errorf("%d fields, expected %d", len(record), len(header))})
+            continue
+        }
+        field := func(name string) string {
+            if i, ok := columns[name]; ok {
+                return strings.TrimSpace(record[i])
+            }
+            return ""
+        }
+        rows = append(rows, DictLocalRow{
+            Word:            field("word"),
+            Advertiser:      field("advertiser"),
+            AffiliateURL:    field("affiliateUrl"),
+            AffiliateItemId: field("affiliateItemId"),
+            ListImage:       field("listImage"),
+            Images:          strings.Fields(field("images")),
+        })
+        lines = append(lines, line)
+    }
+    return rows, lines, nil
+}
+
+// ReadDictJson reads an array of rows. Rows are numbered from 1 as JSON
+// gives no line numbers. Entries that are no valid row are added to ferr.
+func ReadDictJson(data []byte, ferr *DictFileError) ([]DictLocalRow, []int, error) {
+    var entries []json.RawMessage
+    if err := json.Unmarshal(data, &entries); err != nil {
+        return nil, nil, err
+    }
+    var rows []DictLocalRow
+    var lines []int
+    for i, entry := range entries {
+        var row DictLocalRow
+        if err := json.Unmarshal(entry, &row); err != nil {
+            ferr.Errors = append(ferr.Errors, DictLineError{i + 1, err})
+            continue
+        }
+        row.Word = strings.TrimSpace(row.Word)
+        rows = append(rows, row)
+        lines = append(lines, i + 1)
+    }
+    return rows, lines, nil
+}
+
+func IsDictLocalColumn(name string) bool {
+    for _, v := range DICT_LOCAL_COLUMNS {
+        if v == name {
+            return true
+        }
+    }
+    return false
+}
+
+func (row DictLocalRow) Validate() error {
+    if row.Word == "" {
+        return errors.New("missing word")
+    }
+    if strings.ContainsAny(row.Word, "\r\n") {
+        return errors.New("word must be a single line")
+    }
+    if row.AffiliateURL != "" && !IsAbsoluteUrl(row.AffiliateURL) {
+        return fmt.Errorf("invalid affiliateUrl %s", row.AffiliateURL)
+    }
+    if row.ListImage != "" && !IsAbsoluteUrl(row.ListImage) {
+        return fmt.Errorf("invalid listImage %s", row.ListImage)
+    }
+    for _, image := range row.Images {
+        if !IsAbsoluteUrl(image) {
+            return fmt.Errorf("invalid image %s", image)
+        }
+    }
+    return nil
+}
+
+func (row DictLocalRow) Entry() DictEntry {
+    return DictEntry{
+        Word: row.Word,
+        Item: DictItemRedis{
+            Advertiser:      row.Advertiser,
+            AffiliateURL:    row.AffiliateURL,
+            AffiliateItemId: row.AffiliateItemId,
+            ListImage:       row.ListImage,
+            Images:          strings.Join(row.Images, "\n"),
+        },
+    }
+}
+
+func IsAbsoluteUrl(text string) bool {
+    u, err := url.Parse(text)
+    return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func FetchTestDict(t *testing.T, name string, data string) ([]DictEntry, error) {
+    dir, err := ioutil.TempDir("", "colle")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, name)
+    if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+        t.Fatal(err)
+    }
+    p := &DictLocalProvider{}
+    if err := p.Configure([]byte(`{"path": "` + path + `"}`)); err != nil {
+        t.Fatal(err)
+    }
+    return p.Fetch()
+}
+
+func GetDictErrorLines(t *testing.T, err error) []int {
+    ferr, ok := err.(*DictFileError)
+    if !ok {
+        t.Fatalf("error %v is no DictFileError", err)
+    }
+    var result []int
+    for _, v := range ferr.Errors {
+        result = append(result, v.Line)
+    }
+    return result
+}
+
+func EqualInts(a []int, b []int) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for i := range a {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+    return true
+}
+
+func TestDictLocalCsv(t *testing.T) {
+    entries, err := FetchTestDict(t, "dict.csv", "word,affiliateUrl,images\n" +
+        "東京,http://example.com/tokyo,http://example.com/1.jpg http://example.com/2.jpg\n" +
+        "大阪,,\n")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(entries) != 2 || entries[0].Word != "東京" || entries[0].Item.Images != "http://example.com/1.jpg\nhttp://example.com/2.jpg" {
+        t.Errorf("entries = %+v", entries)
+    }
+    _, err = FetchTestDict(t, "dict.csv", "word,affiliateUrl\n" +
+        "東京,example.com\n" +
+        "大阪,\n" +
+        "\n" +
+        ",\n" +
+        "大阪,\n" +
+        "京都\n")
+    if lines := GetDictErrorLines(t, err); !EqualInts(lines, []int{2, 5, 6, 7}) {
+        t.Errorf("error lines = %v, want [2 5 6 7]", lines)
+    }
+}
+
+func TestDictLocalJson(t *testing.T) {
+    entries, err := FetchTestDict(t, "dict.json", `[{"word": " 東京 ", "images": ["http://example.com/1.jpg"]}, {"word": "大阪"}]`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(entries) != 2 || entries[0].Word != "東京" {
+        t.Errorf("entries = %+v", entries)
+    }
+    _, err = FetchTestDict(t, "dict.json", `[
+        {"word": "東京"},
+        {"word": 1},
+        "大阪",
+        {"word": "京都", "images": "http://example.com/1.jpg"},
+        {"word": "東京"},
+        {"word": "奈良", "listImage": "nara.jpg"},
+        {"word": "神戸"}
+    ]`)
+    if lines := GetDictErrorLines(t, err); !EqualInts(lines, []int{2, 3, 4, 5, 6}) {
+        t.Errorf("error entries = %v, want [2 3 4 5 6]", lines)
+    }
+    if _, err := FetchTestDict(t, "dict.json", `{"word": "東京"}`); err == nil {
+        t.Error("no error for a file that is no array")
+    }
+}
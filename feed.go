@@ -0,0 +1,366 @@
+package main
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "html"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "regexp"
+    "strings"
+    "time"
+    "encoding/xml"
+    "golang.org/x/text/encoding/charmap"
+    "golang.org/x/text/encoding/japanese"
+    "golang.org/x/text/transform"
+)
+
+const (
+    NAMESPACE_ATOM = "http://www.w3.org/2005/Atom"
+    NAMESPACE_RDF  = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+    SNIPPET_LENGTH = 120
+)
+
+type rssDocument struct {
+    Channel rssChannel `xml:"channel"`
+    Items   []rssItem  `xml:"item"`
+}
+
+type rssChannel struct {
+    Title       string    `xml:"title"`
+    Links       []xmlLink `xml:"link"`
+    Description string    `xml:"description"`
+    Author      string    `xml:"managingEditor"`
+    Creator     string    `xml:"http://purl.org/dc/elements/1.1/ creator"`
+    Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+    Title       string    `xml:"title"`
+    Links       []xmlLink `xml:"link"`
+    Guid        string    `xml:"guid"`
+    Description string    `xml:"description"`
+    Encoded     string    `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+    PubDate     string    `xml:"pubDate"`
+    Date        string    `xml:"http://purl.org/dc/elements/1.1/ date"`
+    Author      string    `xml:"author"`
+    Creator     string    `xml:"http://purl.org/dc/elements/1.1/ creator"`
+    Categories  []string  `xml:"category"`
+    Subjects    []string  `xml:"http://purl.org/dc/elements/1.1/ subject"`
+}
+
+type atomFeed struct {
+    Title    string      `xml:"title"`
+    Subtitle string      `xml:"subtitle"`
+    Links    []xmlLink   `xml:"link"`
+    Author   atomPerson  `xml:"author"`
+    Entries  []atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+    Title      string         `xml:"title"`
+    Links      []xmlLink      `xml:"link"`
+    Id         string         `xml:"id"`
+    Published  string         `xml:"published"`
+    Updated    string         `xml:"updated"`
+    Summary    atomText       `xml:"summary"`
+    Content    atomText       `xml:"content"`
+    Author     atomPerson     `xml:"author"`
+    Categories []atomCategory `xml:"category"`
+}
+
+type atomText struct {
+    Type  string `xml:"type,attr"`
+    Body  string `xml:",chardata"`
+    Inner string `xml:",innerxml"`
+}
+
+type atomPerson struct {
+    Name string `xml:"name"`
+}
+
+type atomCategory struct {
+    Term string `xml:"term,attr"`
+}
+
+// <link> is plain text in RSS but an empty element with href in Atom,
+// and RSS 2.0 channels often carry an <atom:link rel="self"> as well.
+type xmlLink struct {
+    XMLName xml.Name
+    Href    string `xml:"href,attr"`
+    Rel     string `xml:"rel,attr"`
+    Value   string `xml:",chardata"`
+}
+
+var feedDateFormats = []string{
+    time.RFC1123Z,
+    time.RFC1123,
+    time.RFC3339,
+    time.RFC822Z,
+    time.RFC822,
+    "Mon, 2 Jan 2006 15:04:05 -0700",
+    "Mon, 2 Jan 2006 15:04:05 MST",
+    "Mon, 02 Jan 2006 15:04 -0700",
+    "Mon, 2 Jan 2006 15:04 -0700",
+    "02 Jan 2006 15:04:05 -0700",
+    "2 Jan 2006 15:04:05 -0700",
+    "2006-01-02T15:04:05Z0700",
+    "2006-01-02T15:04Z07:00",
+    "2006-01-02T15:04:05",
+    "2006-01-02 15:04:05",
+    "2006-01-02",
+}
+
+var tagRegexp = regexp.MustCompile(`(?s)<[^>]*>`)
+var spaceRegexp = regexp.MustCompile(`\s+`)
+
+var (
+    ErrFeedNotModified = errors.New("feed not modified")
+    ErrFeedDate        = errors.New("unknown date format")
+)
+
+// GetFeed fetches a channel, sending the validators remembered in state so
+// unchanged feeds come back as 304 and return ErrFeedNotModified. The fetch
+// result is recorded back into state; the new validators are returned in the
+// feed so they are only saved once its items are stored.
+func GetFeed(client *http.Client, channel string, state *ChannelState) (Feed, error) {
+    state.Url = channel
+    state.LastFetch = time.Now().Format(GetDateTimeFormat())
+    request, err := http.NewRequest("GET", channel, nil)
+    if err != nil {
+        return Feed{}, state.SetError(0, err)
+    }
+    if state.ETag != "" {
+        request.Header.Set("If-None-Match", state.ETag)
+    }
+    if state.LastModified != "" {
+        request.Header.Set("If-Modified-Since", state.LastModified)
+    }
+    response, err := client.Do(request)
+    if err != nil {
+        return Feed{}, state.SetError(0, err)
+    }
+    defer response.Body.Close()
+    if response.StatusCode == http.StatusNotModified {
+        state.LastStatus = response.StatusCode
+        state.LastError = ""
+        state.LastSuccess = state.LastFetch
+        return Feed{}, ErrFeedNotModified
+    }
+    if response.StatusCode != http.StatusOK {
+        return Feed{}, state.SetError(response.StatusCode, fmt.Errorf("%s: %s", channel, response.Status))
+    }
+    contents, err := ioutil.ReadAll(response.Body)
+    if err != nil {
+        return Feed{}, state.SetError(response.StatusCode, err)
+    }
+    feed, err := ParseFeed(contents)
+    if err != nil {
+        return feed, state.SetError(response.StatusCode, fmt.Errorf("%s: %s", channel, err.Error()))
+    }
+    feed.FeedUrl = channel
+    feed.ETag = response.Header.Get("ETag")
+    feed.LastModified = response.Header.Get("Last-Modified")
+    state.LastStatus = response.StatusCode
+    state.LastError = ""
+    state.LastSuccess = state.LastFetch
+    state.Bytes = len(contents)
+    state.EntryCount = len(feed.Entries)
+    return feed, nil
+}
+
+// ParseFeed decodes an RSS 2.0, Atom 1.0 or RDF/RSS 1.0 document.
+func ParseFeed(contents []byte) (Feed, error) {
+    decoder := xml.NewDecoder(bytes.NewReader(contents))
+    decoder.CharsetReader = feedCharsetReader
+    decoder.Strict = false
+    decoder.Entity = xml.HTMLEntity
+    for {
+        token, err := decoder.Token()
+        if err != nil {
+            if err == io.EOF {
+                return Feed{}, errors.New("no feed element found")
+            }
+            return Feed{}, err
+        }
+        root, ok := token.(xml.StartElement)
+        if !ok {
+            continue
+        }
+        switch {
+            case root.Name.Local == "rss":
+                var doc rssDocument
+                if err := decoder.DecodeElement(&doc, &root); err != nil {
+                    return Feed{}, err
+                }
+                return newRssFeed(doc.Channel, doc.Channel.Items, "rss"), nil
+            case root.Name.Local == "RDF" && root.Name.Space == NAMESPACE_RDF:
+                var doc rssDocument
+                if err := decoder.DecodeElement(&doc, &root); err != nil {
+                    return Feed{}, err
+                }
+                return newRssFeed(doc.Channel, doc.Items, "rdf"), nil
+            case root.Name.Local == "feed":
+                var doc atomFeed
+                if err := decoder.DecodeElement(&doc, &root); err != nil {
+                    return Feed{}, err
+                }
+                return newAtomFeed(doc), nil
+        }
+        return Feed{}, fmt.Errorf("unsupported feed element <%s>", root.Name.Local)
+    }
+}
+
+func newRssFeed(channel rssChannel, items []rssItem, feedType string) Feed {
+    feed := Feed{
+        Title:       strings.TrimSpace(channel.Title),
+        Link:        getTextLink(channel.Links),
+        Author:      firstNonEmpty(channel.Author, channel.Creator),
+        Description: strings.TrimSpace(channel.Description),
+        Type:        feedType,
+    }
+    for _, item := range items {
+        date, err := GetFeedDateString(firstNonEmpty(item.PubDate, item.Date))
+        if err != nil {
+            feed.Skipped++
+            continue
+        }
+        content := firstNonEmpty(item.Encoded, item.Description)
+        link := getTextLink(item.Links)
+        if link == "" && strings.HasPrefix(item.Guid, "http") {
+            link = strings.TrimSpace(item.Guid)
+        }
+        feed.Entries = append(feed.Entries, Entrie{
+            Title:          strings.TrimSpace(html.UnescapeString(item.Title)),
+            Link:           link,
+            Author:         firstNonEmpty(item.Author, item.Creator),
+            PublishedDate:  date,
+            ContentSnippet: GetContentSnippet(firstNonEmpty(item.Description, item.Encoded)),
+            Content:        content,
+            Categories:     append(item.Categories, item.Subjects...),
+        })
+    }
+    return feed
+}
+
+func newAtomFeed(doc atomFeed) Feed {
+    feed := Feed{
+        Title:       strings.TrimSpace(doc.Title),
+        Link:        getAtomLink(doc.Links),
+        Author:      strings.TrimSpace(doc.Author.Name),
+        Description: strings.TrimSpace(doc.Subtitle),
+        Type:        "atom",
+    }
+    for _, entry := range doc.Entries {
+        date, err := GetFeedDateString(firstNonEmpty(entry.Published, entry.Updated))
+        if err != nil {
+            feed.Skipped++
+            continue
+        }
+        var categories []string
+        for _, c := range entry.Categories {
+            categories = append(categories, c.Term)
+        }
+        author := entry.Author.Name
+        if author == "" {
+            author = doc.Author.Name
+        }
+        feed.Entries = append(feed.Entries, Entrie{
+            Title:          strings.TrimSpace(html.UnescapeString(entry.Title)),
+            Link:           getAtomLink(entry.Links),
+            Author:         strings.TrimSpace(author),
+            PublishedDate:  date,
+            ContentSnippet: GetContentSnippet(firstNonEmpty(entry.Summary.String(), entry.Content.String())),
+            Content:        firstNonEmpty(entry.Content.String(), entry.Summary.String()),
+            Categories:     categories,
+        })
+    }
+    return feed
+}
+
+func (t atomText) String() string {
+    if t.Type == "xhtml" {
+        return t.Inner
+    }
+    return t.Body
+}
+
+func getTextLink(links []xmlLink) string {
+    for _, l := range links {
+        if l.XMLName.Space == NAMESPACE_ATOM {
+            continue
+        }
+        if v := strings.TrimSpace(l.Value); v != "" {
+            return v
+        }
+        if l.Href != "" {
+            return l.Href
+        }
+    }
+    return ""
+}
+
+func getAtomLink(links []xmlLink) string {
+    for _, l := range links {
+        if l.Rel == "" || l.Rel == "alternate" {
+            return strings.TrimSpace(l.Href)
+        }
+    }
+    if len(links) > 0 {
+        return strings.TrimSpace(links[0].Href)
+    }
+    return ""
+}
+
+// GetFeedDateString normalizes the many date formats found in the wild
+// to RFC1123Z, which is what SetItem and GetItem expect. Entries with a
+// missing or unknown date are skipped by the parsers rather than stamped
+// with the current time, which would list them as new on every fetch.
+func GetFeedDateString(datetime string) (string, error) {
+    datetime = strings.TrimSpace(datetime)
+    for _, format := range feedDateFormats {
+        if t, err := time.Parse(format, datetime); err == nil {
+            return t.Format(time.RFC1123Z), nil
+        }
+    }
+    return "", ErrFeedDate
+}
+
+func GetContentSnippet(text string) string {
+    text = html.UnescapeString(tagRegexp.ReplaceAllString(text, " "))
+    text = strings.TrimSpace(spaceRegexp.ReplaceAllString(text, " "))
+    runes := []rune(text)
+    if len(runes) > SNIPPET_LENGTH {
+        return string(runes[:SNIPPET_LENGTH]) + "..."
+    }
+    return text
+}
+
+func firstNonEmpty(values ...string) string {
+    for _, v := range values {
+        if v = strings.TrimSpace(v); v != "" {
+            return v
+        }
+    }
+    return ""
+}
+
+func feedCharsetReader(charset string, input io.Reader) (io.Reader, error) {
+    switch strings.ToLower(charset) {
+        case "euc-jp":
+            return transform.NewReader(input, japanese.EUCJP.NewDecoder()), nil
+        case "shift_jis", "shift-jis", "sjis", "windows-31j", "cp932":
+            return transform.NewReader(input, japanese.ShiftJIS.NewDecoder()), nil
+        case "iso-2022-jp":
+            return transform.NewReader(input, japanese.ISO2022JP.NewDecoder()), nil
+        case "iso-8859-1", "latin1":
+            return transform.NewReader(input, charmap.ISO8859_1.NewDecoder()), nil
+        case "windows-1252":
+            return transform.NewReader(input, charmap.Windows1252.NewDecoder()), nil
+        case "us-ascii", "ascii", "utf8":
+            return input, nil
+    }
+    return nil, fmt.Errorf("unsupported charset %s", charset)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+    "fmt"
+    "testing"
+    "golang.org/x/text/encoding"
+    "golang.org/x/text/encoding/japanese"
+)
+
+const testRss2 = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:atom="http://www.w3.org/2005/Atom" xmlns:content="http://purl.org/rss/1.0/modules/content/">
+<channel>
+    <title>Example News</title>
+    <atom:link rel="self" href="http://example.com/rss"/>
+    <link>http://example.com/</link>
+    <description>News</description>
+    <item>
+        <title>Tokyo &amp; Osaka</title>
+        <link>http://example.com/1</link>
+        <description>&lt;p&gt;Hello &lt;b&gt;world&lt;/b&gt;&lt;/p&gt;</description>
+        <pubDate>Thu, 01 Oct 2015 12:30:00 +0900</pubDate>
+        <category>news</category>
+    </item>
+    <item>
+        <title>Guid only</title>
+        <guid>http://example.com/2</guid>
+        <pubDate>Thu, 1 Oct 2015 12:30:00 GMT</pubDate>
+    </item>
+    <item>
+        <title>No date</title>
+        <link>http://example.com/3</link>
+    </item>
+</channel>
+</rss>`
+
+const testAtom = `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+    <title>Example Atom</title>
+    <link rel="self" href="http://example.com/atom"/>
+    <link rel="alternate" href="http://example.com/"/>
+    <author><name>Editor</name></author>
+    <entry>
+        <title>Atom entry</title>
+        <link rel="alternate" href="http://example.com/a"/>
+        <id>urn:a</id>
+        <updated>2015-10-01T12:30:00+09:00</updated>
+        <summary>Summary text</summary>
+        <category term="tech"/>
+    </entry>
+    <entry>
+        <title>Bad date</title>
+        <link href="http://example.com/b"/>
+        <updated>yesterday</updated>
+    </entry>
+</feed>`
+
+const testRdf = `<?xml version="1.0" encoding="UTF-8"?>
+<rdf:RDF xmlns="http://purl.org/rss/1.0/" xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#" xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <channel>
+        <title>Example RDF</title>
+        <link>http://example.com/</link>
+    </channel>
+    <item>
+        <title>RDF item</title>
+        <link>http://example.com/r</link>
+        <dc:date>2015-10-01T12:30:00+09:00</dc:date>
+        <dc:creator>Writer</dc:creator>
+    </item>
+</rdf:RDF>`
+
+const testJapanese = `<?xml version="1.0" encoding="%s"?>
+<rss version="2.0">
+<channel>
+    <title>日本語ニュース</title>
+    <link>http://example.jp/</link>
+    <item>
+        <title>東京の天気</title>
+        <link>http://example.jp/1</link>
+        <pubDate>Thu, 01 Oct 2015 12:30:00 +0900</pubDate>
+    </item>
+</channel>
+</rss>`
+
+func EncodeTestFeed(t *testing.T, enc encoding.Encoding, charset string) []byte {
+    data, err := enc.NewEncoder().Bytes([]byte(fmt.Sprintf(testJapanese, charset)))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return data
+}
+
+func TestParseFeed(t *testing.T) {
+    tests := []struct {
+        name     string
+        contents []byte
+        feedType string
+        title    string
+        link     string
+        skipped  int
+        entries  []Entrie
+    }{
+        {"rss2", []byte(testRss2), "rss", "Example News", "http://example.com/", 1, []Entrie{
+            {Title: "Tokyo & Osaka", Link: "http://example.com/1", PublishedDate: "Thu, 01 Oct 2015 12:30:00 +0900", ContentSnippet: "Hello world"},
+            {Title: "Guid only", Link: "http://example.com/2", PublishedDate: "Thu, 01 Oct 2015 12:30:00 +0000"},
+        }},
+        {"atom", []byte(testAtom), "atom", "Example Atom", "http://example.com/", 1, []Entrie{
+            {Title: "Atom entry", Link: "http://example.com/a", Author: "Editor", PublishedDate: "Thu, 01 Oct 2015 12:30:00 +0900", ContentSnippet: "Summary text"},
+        }},
+        {"rdf", []byte(testRdf), "rdf", "Example RDF", "http://example.com/", 0, []Entrie{
+            {Title: "RDF item", Link: "http://example.com/r", Author: "Writer", PublishedDate: "Thu, 01 Oct 2015 12:30:00 +0900"},
+        }},
+        {"shift_jis", EncodeTestFeed(t, japanese.ShiftJIS, "Shift_JIS"), "rss", "日本語ニュース", "http://example.jp/", 0, []Entrie{
+            {Title: "東京の天気", Link: "http://example.jp/1", PublishedDate: "Thu, 01 Oct 2015 12:30:00 +0900"},
+        }},
+        {"euc-jp", EncodeTestFeed(t, japanese.EUCJP, "EUC-JP"), "rss", "日本語ニュース", "http://example.jp/", 0, []Entrie{
+            {Title: "東京の天気", Link: "http://example.jp/1", PublishedDate: "Thu, 01 Oct 2015 12:30:00 +0900"},
+        }},
+    }
+    for _, test := range tests {
+        feed, err := ParseFeed(test.contents)
+        if err != nil {
+            t.Errorf("%s: %s", test.name, err.Error())
+            continue
+        }
+        if feed.Type != test.feedType || feed.Title != test.title || feed.Link != test.link || feed.Skipped != test.skipped {
+            t.Errorf("%s: type %q, title %q, link %q, skipped %d", test.name, feed.Type, feed.Title, feed.Link, feed.Skipped)
+        }
+        if len(feed.Entries) != len(test.entries) {
+            t.Errorf("%s: %d entries, want %d", test.name, len(feed.Entries), len(test.entries))
+            continue
+        }
+        for i, want := range test.entries {
+            got := feed.Entries[i]
+            if got.Title != want.Title || got.Link != want.Link || got.Author != want.Author || got.PublishedDate != want.PublishedDate {
+                t.Errorf("%s: entry %d = %+v, want %+v", test.name, i, got, want)
+            }
+            if want.ContentSnippet != "" && got.ContentSnippet != want.ContentSnippet {
+                t.Errorf("%s: entry %d snippet %q, want %q", test.name, i, got.ContentSnippet, want.ContentSnippet)
+            }
+        }
+    }
+}
+
+func TestParseFeedError(t *testing.T) {
+    for _, contents := range []string{"", "<html><body></body></html>", `<?xml version="1.0" encoding="KOI8-R"?><rss></rss>`} {
+        if _, err := ParseFeed([]byte(contents)); err == nil {
+            t.Errorf("ParseFeed(%q) returned no error", contents)
+        }
+    }
+}
+
+func TestGetFeedDateString(t *testing.T) {
+    tests := []struct {
+        text string
+        want string
+    }{
+        {"Thu, 01 Oct 2015 12:30:00 +0900", "Thu, 01 Oct 2015 12:30:00 +0900"},
+        {"Thu, 1 Oct 2015 12:30:00 +0900", "Thu, 01 Oct 2015 12:30:00 +0900"},
+        {"Thu, 01 Oct 2015 12:30 +0900", "Thu, 01 Oct 2015 12:30:00 +0900"},
+        {"2015-10-01T12:30:00+09:00", "Thu, 01 Oct 2015 12:30:00 +0900"},
+        {"2015-10-01T12:30:00Z", "Thu, 01 Oct 2015 12:30:00 +0000"},
+        {"2015-10-01T12:30+09:00", "Thu, 01 Oct 2015 12:30:00 +0900"},
+        {"2015-10-01 12:30:00", "Thu, 01 Oct 2015 12:30:00 +0000"},
+        {" 2015-10-01 ", "Thu, 01 Oct 2015 00:00:00 +0000"},
+    }
+    for _, test := range tests {
+        got, err := GetFeedDateString(test.text)
+        if err != nil || got != test.want {
+            t.Errorf("GetFeedDateString(%q) = %q, %v, want %q", test.text, got, err, test.want)
+        }
+    }
+    for _, text := range []string{"", "yesterday", "2015/10/01"} {
+        if got, err := GetFeedDateString(text); err != ErrFeedDate {
+            t.Errorf("GetFeedDateString(%q) = %q, %v, want ErrFeedDate", text, got, err)
+        }
+    }
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+    "errors"
+    "math/rand"
+    "net/http"
+    "net/url"
+    "sync"
+    "time"
+    "github.com/Sirupsen/logrus"
+)
+
+const (
+    DEFAULT_FETCH_WORKERS          = 4
+    DEFAULT_FETCH_HOST_CONCURRENCY = 2
+    DEFAULT_FETCH_TIMEOUT          = 30
+    DEFAULT_FETCH_RETRY            = 2
+    DEFAULT_FETCH_RETRY_WAIT       = 2
+    MAX_FETCH_RETRY_WAIT           = 60
+)
+
+var ErrChannelQuarantined = errors.New("channel quarantined")
+
+type FetchResult struct {
+    Channel Channel
+    State   ChannelState
+    Feed    Feed
+    Err     error
+}
+
+type FetchSummary struct {
+    Success     int
+    NotModified int
+    Failed      int
+    Quarantined int
+    NewItems    int
+}
+
+// FeedFetcher fetches channels with a fixed number of workers, allowing at
+// most HostConcurrency requests to the same host at a time. Failed requests
+// are retried up to Retry times with exponential backoff.
+type FeedFetcher struct {
+    Client          *http.Client
+    Workers         int
+    HostConcurrency int
+    Retry           int
+    RetryWait       time.Duration
+    mu              sync.Mutex
+    hosts           map[string]chan struct{}
+}
+
+func NewFeedFetcher(conf ConfigFeed) *FeedFetcher {
+    workers := conf.Workers
+    if workers <= 0 {
+        workers = DEFAULT_FETCH_WORKERS
+    }
+    hostConcurrency := conf.HostConcurrency
+    if hostConcurrency <= 0 {
+        hostConcurrency = DEFAULT_FETCH_HOST_CONCURRENCY
+    }
+    timeout := conf.Timeout
+    if timeout <= 0 {
+        timeout = DEFAULT_FETCH_TIMEOUT
+    }
+    retry := conf.Retry
+    if retry < 0 {
+        retry = 0
+    } else if retry == 0 {
+        retry = DEFAULT_FETCH_RETRY
+    }
+    retryWait := conf.RetryWait
+    if retryWait <= 0 {
+        retryWait = DEFAULT_FETCH_RETRY_WAIT
+    }
+    return &FeedFetcher{
+        Client:          &http.Client{Timeout: time.Duration(timeout) * time.Second},
+        Workers:         workers,
+        HostConcurrency: hostConcurrency,
+        Retry:           retry,
+        RetryWait:       time.Duration(retryWait) * time.Second,
+        hosts:           make(map[string]chan struct{}),
+    }
+}
+
+// Fetch returns a channel yielding one result per channel in completion
+// order. It is closed once every channel has been fetched.
+func (f *FeedFetcher) Fetch(channel []Channel, getState func(Channel) ChannelState) <-chan FetchResult {
+    workers := make(chan struct{}, f.Workers)
+    results := make(chan FetchResult)
+    var wg sync.WaitGroup
+    for _, v := range channel {
+        wg.Add(1)
+        go func(v Channel) {
+            results <- f.fetch(v, getState(v), workers)
+            wg.Done()
+        }(v)
+    }
+    go func() {
+        wg.Wait()
+        close(results)
+    }()
+    return results
+}
+
+// fetch takes a slot of the host before a worker slot, so channels waiting
+// for a busy host never hold workers that other hosts could use. Both are
+// given back while waiting to retry.
+func (f *FeedFetcher) fetch(channel Channel, state ChannelState, workers chan struct{}) FetchResult {
+    if state.IsQuarantined(time.Now()) {
+        return FetchResult{channel, state, Feed{}, ErrChannelQuarantined}
+    }
+    semaphore := f.hostSemaphore(channel.Url)
+    var feed Feed
+    var err error
+    for attempt := 0; ; attempt++ {
+        semaphore <- struct{}{}
+        workers <- struct{}{}
+        feed, err = GetFeed(f.Client, channel.Url, &state)
+        <-workers
+        <-semaphore
+        if err == nil || err == ErrFeedNotModified || attempt >= f.Retry || !IsRetryableStatus(state.LastStatus) {
+            break
+        }
+        time.Sleep(GetBackoff(f.RetryWait, attempt))
+    }
+    return FetchResult{channel, state, feed, err}
+}
+
+// IsRetryableStatus reports whether a failed fetch may succeed on retry:
+// network errors (status 0), throttling and server errors.
+func IsRetryableStatus(status int) bool {
+    return status == 0 || status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// GetBackoff doubles the wait on every attempt and adds up to 50% jitter so
+// channels on the same host do not retry in lockstep.
+func GetBackoff(base time.Duration, attempt int) time.Duration {
+    wait := base << uint(attempt)
+    if max := MAX_FETCH_RETRY_WAIT * time.Second; wait > max || wait <= 0 {
+        wait = max
+    }
+    return wait + time.Duration(rand.Int63n(int64(wait / 2) + 1))
+}
+
+func (f *FeedFetcher) hostSemaphore(channel string) chan struct{} {
+    host := channel
+    if u, err := url.Parse(channel); err == nil {
+        host = u.Host
+    }
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    semaphore, ok := f.hosts[host]
+    if !ok {
+        semaphore = make(chan struct{}, f.HostConcurrency)
+        f.hosts[host] = semaphore
+    }
+    return semaphore
+}
+
+func (s FetchSummary) Fields(elapsed time.Duration) logrus.Fields {
+    fields := SetUpdateLog("feed")
+    fields["success"] = s.Success
+    fields["notModified"] = s.NotModified
+    fields["failed"] = s.Failed
+    fields["quarantined"] = s.Quarantined
+    fields["newItems"] = s.NewItems
+    fields["elapsed"] = elapsed.String()
+    return fields
+}
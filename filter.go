@@ -0,0 +1,217 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "github.com/Sirupsen/logrus"
+)
+
+const (
+    DEFAULT_CLICK_RATE_LIMIT   = 30
+    DEFAULT_CLICK_TOKEN_TTL    = 60
+    DEFAULT_CLICK_TRUSTED_HOPS = 1
+    CLICK_OUTLINK              = "outlink"
+    CLICK_INLINK               = "inlink"
+)
+
+var DEFAULT_CLICK_BOTS = []string{
+    "bot", "crawler", "spider", "slurp", "preview", "headless", "facebookexternalhit",
+    "curl", "wget", "python", "go-http-client", "java/", "libwww", "httpclient",
+}
+
+var (
+    ErrClickBot       = errors.New("bot user agent")
+    ErrClickReferer   = errors.New("foreign or missing referer")
+    ErrClickRateLimit = errors.New("rate limit exceeded")
+    ErrClickToken     = errors.New("invalid token")
+)
+
+// ClickFilter decides which clicks are counted. Outlinks come from the
+// rendered pages and must pass every check: no bot User-Agent, a Referer
+// or Origin of the site, the per-IP rate limit and the page token. Inlinks
+// come from feed readers without Referer or token, so only the User-Agent
+// and the rate limit are checked.
+type ClickFilter struct {
+    Disable    bool
+    Bots       []string
+    Origins    []string
+    RateLimit  int
+    TokenTTL   time.Duration
+    ProxyHops  int
+    secret     []byte
+    mu         sync.Mutex
+    hits       map[string]*clickCounter
+    sweep      time.Time
+}
+
+type clickCounter struct {
+    start time.Time
+    count int
+}
+
+func NewClickFilter(userconf *UserConfig) *ClickFilter {
+    conf := userconf.Click
+    f := &ClickFilter{
+        Disable:    conf.DisableFilter,
+        Bots:       DEFAULT_CLICK_BOTS,
+        RateLimit:  GetConfigInt(conf.RateLimit, DEFAULT_CLICK_RATE_LIMIT),
+        TokenTTL:   time.Duration(GetConfigInt(conf.TokenTTL, DEFAULT_CLICK_TOKEN_TTL)) * time.Minute,
+        secret:     []byte(conf.Secret),
+        hits:       make(map[string]*clickCounter),
+    }
+    if conf.TrustProxy {
+        f.ProxyHops = GetConfigInt(conf.TrustedHops, DEFAULT_CLICK_TRUSTED_HOPS)
+    }
+    if len(conf.Bots) > 0 {
+        f.Bots = conf.Bots
+    }
+    if u, err := url.Parse(userconf.Site.Url); err == nil && u.Host != "" {
+        f.Origins = append(f.Origins, u.Host)
+    }
+    f.Origins = append(f.Origins, conf.Origins...)
+    if len(f.secret) == 0 {
+        // Tokens signed with a random secret stop working on restart.
+        f.secret = make([]byte, 32)
+        rand.Read(f.secret)
+    }
+    return f
+}
+
+// Check returns why a click on the item id must not be counted, or nil.
+func (f *ClickFilter) Check(r *http.Request, kind string, id string) error {
+    if f.Disable {
+        return nil
+    }
+    if f.IsBot(r.UserAgent()) {
+        return ErrClickBot
+    }
+    if kind == CLICK_OUTLINK && !f.IsSameOrigin(r) {
+        return ErrClickReferer
+    }
+    if !f.Allow(GetClientIp(r, f.ProxyHops)) {
+        return ErrClickRateLimit
+    }
+    if kind == CLICK_OUTLINK && !f.IsValidToken(r.FormValue("token"), id, f.getVisitor(r)) {
+        return ErrClickToken
+    }
+    return nil
+}
+
+func (f *ClickFilter) IsBot(useragent string) bool {
+    useragent = strings.ToLower(useragent)
+    if useragent == "" {
+        return true
+    }
+    for _, bot := range f.Bots {
+        if strings.Contains(useragent, strings.ToLower(bot)) {
+            return true
+        }
+    }
+    return false
+}
+
+// IsSameOrigin checks the Origin header, or the Referer when there is
+// none, against the host of site.url, click.origins and the request Host.
+func (f *ClickFilter) IsSameOrigin(r *http.Request) bool {
+    origin := r.Header.Get("Origin")
+    if origin == "" {
+        origin = r.Referer()
+    }
+    u, err := url.Parse(origin)
+    if err != nil || u.Host == "" {
+        return false
+    }
+    if strings.EqualFold(u.Host, r.Host) {
+        return true
+    }
+    for _, host := range f.Origins {
+        if strings.EqualFold(u.Host, host) {
+            return true
+        }
+    }
+    return false
+}
+
+// Allow counts a click of ip and reports whether it is within RateLimit
+// clicks per minute.
+func (f *ClickFilter) Allow(ip string) bool {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    now := time.Now()
+    if now.Sub(f.sweep) > time.Minute {
+        for k, c := range f.hits {
+            if now.Sub(c.start) >= time.Minute {
+                delete(f.hits, k)
+            }
+        }
+        f.sweep = now
+    }
+    c, ok := f.hits[ip]
+    if !ok || now.Sub(c.start) >= time.Minute {
+        f.hits[ip] = &clickCounter{now, 1}
+        return true
+    }
+    c.count++
+    return c.count <= f.RateLimit
+}
+
+// NewToken returns a token for the link of the item id on a page rendered
+// for visitor: the render time and its HMAC signature over the item and the
+// visitor, so a token cannot be replayed for other items or visitors.
+func (f *ClickFilter) NewToken(id string, visitor string) string {
+    ts := strconv.FormatInt(time.Now().Unix(), 10)
+    return ts + "." + f.sign(ts + ":" + id + ":" + visitor)
+}
+
+// GetTokenFunc returns the token function of a page, called by the
+// templates with the ID of each item they link.
+func (f *ClickFilter) GetTokenFunc(r *http.Request) func(int) string {
+    visitor := f.getVisitor(r)
+    return func(id int) string {
+        return f.NewToken(strconv.Itoa(id), visitor)
+    }
+}
+
+func (f *ClickFilter) IsValidToken(token string, id string, visitor string) bool {
+    parts := strings.SplitN(token, ".", 2)
+    if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(f.sign(parts[0] + ":" + id + ":" + visitor))) {
+        return false
+    }
+    ts, err := strconv.ParseInt(parts[0], 10, 64)
+    if err != nil {
+        return false
+    }
+    age := time.Since(time.Unix(ts, 0))
+    return age > -time.Minute && age <= f.TokenTTL
+}
+
+func (f *ClickFilter) getVisitor(r *http.Request) string {
+    visitor, _ := f.GetVisitorId(r)
+    return visitor
+}
+
+func (f *ClickFilter) sign(text string) string {
+    mac := hmac.New(sha256.New, f.secret)
+    mac.Write([]byte(text))
+    return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+func SetClickLog(r *http.Request, kind string, id string, hops int) logrus.Fields {
+    return logrus.Fields{
+            "category": "click",
+            "kind": kind,
+            "id": id,
+            "ip": GetClientIp(r, hops),
+            "userAgent": r.UserAgent(),
+            "referer": r.Referer(),
+        }
+}
@@ -4,13 +4,11 @@ import (
     "fmt"
     "encoding/json"
     "io/ioutil"
-    "strings"
     "flag"
     "net/http"
     "regexp"
     "time"
     "runtime"
-    "net/url"
     "os"
     "path/filepath"
     "github.com/flosch/pongo2"
@@ -21,24 +19,17 @@ import (
     "github.com/Sirupsen/logrus"
 )
 
-type ResponseData struct {
-    ResponseData    Feeds  `json:"responseData"`
-    ResponseDetails string `json:"responseDetails"`
-    ResponseStatus  int    `json:"responseStatus"`
-}
-
-type Feeds struct {
-    Feed Feed `json:"feed"`
-}
-
 type Feed struct {
-    FeedUrl     string   `json:"feedUrl"`
-    Title       string   `json:"title"`
-    Link        string   `json:"link"`
-    Author      string   `json:"author"`
-    Description string   `json:"description"`
-    Type        string   `json:"type"`
-    Entries     []Entrie `json:"entries"`
+    FeedUrl      string   `json:"feedUrl"`
+    Title        string   `json:"title"`
+    Link         string   `json:"link"`
+    Author       string   `json:"author"`
+    Description  string   `json:"description"`
+    Type         string   `json:"type"`
+    Entries      []Entrie `json:"entries"`
+    Skipped      int      `json:"-"`
+    ETag         string   `json:"-"`
+    LastModified string   `json:"-"`
 }
 
 type Entrie struct {
@@ -52,10 +43,14 @@ type Entrie struct {
 }
 
 type UserConfig struct {
-    Site  ConfigSite  `json:"site"`
-    Redis ConfigRedis `json:"redis"`
-    Feed  ConfigFeed  `json:"feed"`
-    Dict  ConfigDict  `json:"dict"`
+    Site     ConfigSite     `json:"site"`
+    Storage  ConfigStorage  `json:"storage"`
+    Redis    ConfigRedis    `json:"redis"`
+    Feed     ConfigFeed     `json:"feed"`
+    Dict     ConfigDict     `json:"dict"`
+    Schedule ConfigSchedule `json:"schedule"`
+    Ranking  ConfigRanking  `json:"ranking"`
+    Click    ConfigClick    `json:"click"`
 }
 
 type ConfigSite struct {
@@ -77,41 +72,110 @@ type Service struct {
     GoogleAnalyticsTrackingId string `json:"googleAnalyticsTrackingId"`
 }
 
+type ConfigStorage struct {
+    Driver string `json:"driver"`
+    Path   string `json:"path"`
+}
+
 type ConfigRedis struct {
-    Protocol   string `json:"protocol"`
-    Server     string `json:"server"`
-    DatabaseNo int    `json:"databaseNo"`
+    Protocol       string `json:"protocol"`
+    Server         string `json:"server"`
+    DatabaseNo     int    `json:"databaseNo"`
+    MaxIdle        int    `json:"maxIdle"`
+    MaxActive      int    `json:"maxActive"`
+    IdleTimeout    int    `json:"idleTimeout"`
+    ConnectTimeout int    `json:"connectTimeout"`
+    ReadTimeout    int    `json:"readTimeout"`
+    WriteTimeout   int    `json:"writeTimeout"`
 }
 
 type ConfigFeed struct {
-    Category []ChannelCategory `json:"category"`
-    Channel  []Channel         `json:"channel"`
+    Category            []ChannelCategory `json:"category"`
+    Channel             []Channel         `json:"channel"`
+    StaleHours          int               `json:"staleHours"`
+    Workers             int               `json:"workers"`
+    HostConcurrency     int               `json:"hostConcurrency"`
+    Timeout             int               `json:"timeout"`
+    Retry               int               `json:"retry"`
+    RetryWait           int               `json:"retryWait"`
+    QuarantineThreshold int               `json:"quarantineThreshold"`
+    QuarantineInterval  int               `json:"quarantineInterval"`
+    Canonical           ConfigCanonical   `json:"canonical"`
+    Cluster             ConfigCluster     `json:"cluster"`
 }
 
 type ChannelCategory struct {
-    Dir   string `json:"dir"`
-    Label string `json:"label"`
+    Dir     string        `json:"dir"`
+    Label   string        `json:"label"`
+    Ranking ConfigRanking `json:"ranking"`
 }
 
 type Channel struct {
     Url      string `json:"url"`
     Category string `json:"category"`
     IsDict   bool   `json:"isDict"`
+    Interval int    `json:"interval"`
 }
 
+// ConfigDict holds the dictionaries in use, the scoring of matches and a
+// section per provider, e.g. "DMMR18ACT": {...}, decoded by the provider.
 type ConfigDict struct {
-    Use       []string  `json:"use"`
-    DMMR18ACT DMMR18ACT `json:"DMMR18ACT"`
+    Use       []string
+    Score     ConfigDictScore
+    Providers map[string]json.RawMessage
+}
+
+type ConfigDictScore struct {
+    Rules       []string `json:"rules"`
+    Advertisers []string `json:"advertisers"`
+}
+
+type ConfigCanonical struct {
+    Disable          bool     `json:"disable"`
+    StripParams      []string `json:"stripParams"`
+    Scheme           string   `json:"scheme"`
+    MobileSubdomains []string `json:"mobileSubdomains"`
+    ResolveCanonical bool     `json:"resolveCanonical"`
 }
 
-type DMMR18ACT struct {
-    ApiId       string `json:"apiId"`
-    AffiliateId string `json:"affiliateId"`
+type ConfigCluster struct {
+    Disable  bool `json:"disable"`
+    Distance int  `json:"distance"`
+    Days     int  `json:"days"`
+}
+
+type ConfigRanking struct {
+    Mode     string  `json:"mode"`
+    HalfLife float64 `json:"halfLife"`
+    Gravity  float64 `json:"gravity"`
+    InWeight float64 `json:"inWeight"`
+}
+
+type ConfigClick struct {
+    Unique        bool     `json:"unique"`
+    TrustProxy    bool     `json:"trustProxy"`
+    TrustedHops   int      `json:"trustedHops"`
+    DisableFilter bool     `json:"disableFilter"`
+    Bots          []string `json:"bots"`
+    Origins       []string `json:"origins"`
+    RateLimit     int      `json:"rateLimit"`
+    Secret        string   `json:"secret"`
+    TokenTTL      int      `json:"tokenTTL"`
+}
+
+type ConfigSchedule struct {
+    FeedInterval      int `json:"feedInterval"`
+    DictInterval      int `json:"dictInterval"`
+    RetentionInterval int `json:"retentionInterval"`
+    RankingInterval   int `json:"rankingInterval"`
 }
 
 type CommandlineOptions struct {
     Version bool   `short:"v" long:"version" description:"Show program's version number"`
-    Update  string `short:"u" long:"update"  description:"Update items / feed, dict"`
+    Update  string `short:"u" long:"update"  description:"Update items / feed, dict, repair, prune, rank, search"`
+    Daemon  bool   `short:"d" long:"daemon"  description:"Run updates on a schedule inside the server"`
+    DryRun  bool   `long:"dry-run"           description:"Report what prune would remove without removing it"`
+    Orphans bool   `long:"orphans"           description:"Let prune also remove feed:exists links no item accounts for"`
 }
 
 const (
@@ -136,7 +200,7 @@ func main() {
 
     parser := flags.NewParser(&cmdopt, flags.Default)
     parser.Name = "colle"
-    parser.Usage = "[-u] [-v] 'Use config file'"
+    parser.Usage = "[-u] [-d] [-v] 'Use config file'"
     args, err := parser.Parse()
     if err != nil {
         os.Exit(0)
@@ -154,12 +218,12 @@ func main() {
 
     userconf = NewUserConfig(configfile)
     dm := NewDataManager(&userconf, execdir)
-    if dm.Get().Err() != nil {
-        fmt.Println(dm.Get().Err().Error())
+    if err := dm.Store.Ping(); err != nil {
+        fmt.Println(err.Error())
         os.Exit(1)
     }
 
-    defer dm.Close()
+    defer dm.Store.Close()
 
     templateDir := dm.UserConfig.Site.TemplateDir
     if len(templateDir) == 0 {
@@ -176,15 +240,57 @@ func main() {
                 for _, v := range userconf.Dict.Use {
                     dm.SetDict(v)
                 }
+            case "repair":
+                fmt.Println(dm.RepairItems(userconf.Feed.Channel))
+            case "prune":
+                report := dm.PruneItems(cmdopt.DryRun)
+                if cmdopt.Orphans {
+                    report.OrphanLinks = dm.PruneOrphanLinks(cmdopt.DryRun)
+                }
+                fmt.Println(report)
+            case "rank":
+                dm.SetRankSnapshot()
+            case "search":
+                dm.SetSearchIndex()
         }
         os.Exit(0)
     }
 
-    cntr := NewController(dm)
+    var scheduler *Scheduler
+    if cmdopt.Daemon {
+        scheduler = NewScheduler(dm.Logger)
+        scheduler.AddJob("feed", GetFeedTickInterval(&userconf), func() {
+            dm.SetFeed(dm.GetDueChannels(userconf.Feed.Channel))
+        })
+        scheduler.AddJob("retention", GetRetentionInterval(&userconf), func() {
+            dm.PruneItems(false)
+        })
+        scheduler.AddJob("ranking", GetRankingInterval(&userconf), func() {
+            dm.SetRankSnapshot()
+        })
+        if len(userconf.Dict.Use) > 0 {
+            scheduler.AddJob("dict", GetDictInterval(&userconf), func() {
+                for _, v := range userconf.Dict.Use {
+                    dm.SetDict(v)
+                }
+            })
+        }
+        scheduler.Start()
+    }
+
+    cntr := NewController(dm, scheduler)
     goji.Get("/", cntr.Root)
     goji.Get("/:category/", cntr.Root)
+    goji.Get("/rank/:window", cntr.Rank)
+    goji.Get("/:category/rank/:window", cntr.Rank)
+    goji.Get("/search", cntr.Search)
+    goji.Get("/tag/:tag", cntr.Tag)
     goji.Get("/feed", cntr.NewFeed)
     goji.Get("/:category/feed", cntr.NewFeed)
+    goji.Get("/feed.atom", cntr.AtomFeed)
+    goji.Get("/:category/feed.atom", cntr.AtomFeed)
+    goji.Get("/feed.json", cntr.JsonFeed)
+    goji.Get("/:category/feed.json", cntr.JsonFeed)
 
     assetsDir := dm.UserConfig.Site.AssetsDir
     if len(assetsDir) == 0 {
@@ -196,39 +302,20 @@ func main() {
     goji.Handle("/api/*", api)
     api.Use(middleware.SubRouter)
     api.Post("/outlink/:id", cntr.ApiOutLink)
+    api.Get("/channels", cntr.ApiChannels)
+    api.Get("/schedule", cntr.ApiSchedule)
+    api.Get("/referrals", cntr.ApiReferrals)
+    api.Get("/items", cntr.ApiItems)
+    api.Get("/items/:id", cntr.ApiItem)
+    api.Get("/rankings/:window", cntr.ApiRankings)
+    api.Get("/categories", cntr.ApiCategories)
+    api.Get("/search", cntr.ApiSearch)
+    api.NotFound(cntr.ApiNotFound)
 
     flag.Set("bind", ":" + userconf.Site.ListenPort)
     goji.Serve()
 }
 
-func GetFeed(channel string) ResponseData {
-    values := url.Values{}
-    values.Add("num", "30")
-    values.Add("v", "1.0")
-    values.Add("q", channel)
-    response, err := http.Get("http://ajax.googleapis.com/ajax/services/feed/load?" + values.Encode())
-    if err != nil {
-        fmt.Println(err)
-    }
-    defer response.Body.Close()
-    contents, err := ioutil.ReadAll(response.Body)
-    if err != nil {
-        fmt.Println(err)
-    }
-    var r ResponseData
-    json.Unmarshal(contents, &r)
-    return r
-}
-
-func GetMatchingWord(text string, dict []string) interface{} {
-    for _, v := range dict {
-        if strings.Contains(text, v) {
-            return v
-        }
-    }
-    return nil
-}
-
 func GetDateTimeRange(min int, max int) []string {
     t := time.Now().AddDate(0, 0, max)
     var result []string
@@ -306,6 +393,14 @@ func NewLogger(filename string) *logrus.Logger {
     return logger
 }
 
+// GetConfigInt returns value, or def when the setting is left out.
+func GetConfigInt(value int, def int) int {
+    if value <= 0 {
+        return def
+    }
+    return value
+}
+
 func SetUpdateLog(category string) logrus.Fields {
     return logrus.Fields{
             "category": category,
@@ -0,0 +1,139 @@
+package main
+
+import (
+    "sort"
+)
+
+// Matcher finds every dictionary word in a text in one pass (Aho-Corasick).
+// It walks the UTF-8 bytes; as UTF-8 is self-synchronizing, words can only
+// match at rune boundaries. Build it once per update with NewMatcher.
+type Matcher struct {
+    nodes []matcherNode
+    words []string
+}
+
+type matcherNode struct {
+    next   map[byte]int
+    fail   int
+    word   int // index into words of the word ending here, or -1
+    output int // nearest node on the fail chain ending a word, or -1
+}
+
+// Match is a word found in a text; Start and End are byte offsets.
+type Match struct {
+    Word  string
+    Start int
+    End   int
+}
+
+func NewMatcher(words []string) *Matcher {
+    m := &Matcher{nodes: []matcherNode{newMatcherNode()}}
+    for _, word := range words {
+        if word == "" {
+            continue
+        }
+        n := 0
+        for i := 0; i < len(word); i++ {
+            next, ok := m.nodes[n].next[word[i]]
+            if !ok {
+                next = len(m.nodes)
+                m.nodes = append(m.nodes, newMatcherNode())
+                m.nodes[n].next[word[i]] = next
+            }
+            n = next
+        }
+        if m.nodes[n].word < 0 {
+            m.nodes[n].word = len(m.words)
+            m.words = append(m.words, word)
+        }
+    }
+
+    // Breadth first, so the fail node of a parent is done before its
+    // children.
+    queue := []int{}
+    for _, child := range m.nodes[0].next {
+        queue = append(queue, child)
+    }
+    for len(queue) > 0 {
+        n := queue[0]
+        queue = queue[1:]
+        for c, child := range m.nodes[n].next {
+            queue = append(queue, child)
+            fail := m.nodes[n].fail
+            for fail > 0 && !m.hasNext(fail, c) {
+                fail = m.nodes[fail].fail
+            }
+            if next, ok := m.nodes[fail].next[c]; ok {
+                fail = next
+            }
+            m.nodes[child].fail = fail
+            if m.nodes[fail].word >= 0 {
+                m.nodes[child].output = fail
+            } else {
+                m.nodes[child].output = m.nodes[fail].output
+            }
+        }
+    }
+    return m
+}
+
+func newMatcherNode() matcherNode {
+    return matcherNode{next: make(map[byte]int), word: -1, output: -1}
+}
+
+func (m *Matcher) hasNext(n int, c byte) bool {
+    _, ok := m.nodes[n].next[c]
+    return ok
+}
+
+// FindAll returns every occurrence of every word, overlapping ones
+// included, ordered by where they end.
+func (m *Matcher) FindAll(text string) []Match {
+    var result []Match
+    if m == nil || len(m.words) == 0 {
+        return result
+    }
+    n := 0
+    for i := 0; i < len(text); i++ {
+        for n > 0 && !m.hasNext(n, text[i]) {
+            n = m.nodes[n].fail
+        }
+        if next, ok := m.nodes[n].next[text[i]]; ok {
+            n = next
+        }
+        for o := n; o > 0; o = m.nodes[o].output {
+            if w := m.nodes[o].word; w >= 0 {
+                result = append(result, Match{m.words[w], i + 1 - len(m.words[w]), i + 1})
+            }
+        }
+    }
+    return result
+}
+
+// Match returns the words found in text without overlaps, in text order.
+// Where words overlap the leftmost wins, and of those the longest, so a
+// short name never hides a longer one that contains it.
+func (m *Matcher) Match(text string) []Match {
+    all := m.FindAll(text)
+    sort.Sort(byMatchPosition(all))
+    var result []Match
+    end := 0
+    for _, match := range all {
+        if match.Start >= end {
+            result = append(result, match)
+            end = match.End
+        }
+    }
+    return result
+}
+
+type byMatchPosition []Match
+
+func (a byMatchPosition) Len() int      { return len(a) }
+func (a byMatchPosition) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byMatchPosition) Less(i, j int) bool {
+    if a[i].Start != a[j].Start {
+        return a[i].Start < a[j].Start
+    }
+    return a[i].End > a[j].End
+}
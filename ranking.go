@@ -0,0 +1,304 @@
+package main
+
+import (
+    "math"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    DEFAULT_RANKING_INTERVAL  = 5
+    DEFAULT_RANKING_HALF_LIFE = 24
+    DEFAULT_RANKING_GRAVITY   = 1.8
+    DEFAULT_RANKING_IN_WEIGHT = 1
+    DEFAULT_RANK_HOUR_DAYS    = 2
+)
+
+// Ranking windows. RANK_WINDOW_DAYS covers site.itemDays and is the
+// ranking shown with the new items; the others have their own pages.
+// Windows counted in hours read the hourly buckets, the others the daily
+// ones.
+const (
+    RANK_WINDOW_DAYS = "days"
+    RANK_WINDOW_1H   = "1h"
+    RANK_WINDOW_24H  = "24h"
+    RANK_WINDOW_7D   = "7d"
+    RANK_WINDOW_30D  = "30d"
+)
+
+var RANK_WINDOWS = []string{RANK_WINDOW_1H, RANK_WINDOW_24H, RANK_WINDOW_7D, RANK_WINDOW_30D}
+
+// RankBucket is one hour or day of clicks within a window. Age is the
+// hours since the bucket started, Weight the share of it that lies within
+// the window.
+type RankBucket struct {
+    Time   time.Time
+    Hourly bool
+    Age    float64
+    Weight float64
+}
+
+func (b RankBucket) Keyname(stream string) string {
+    return GetRankKeyname(stream, b.Time, b.Hourly)
+}
+
+// Ranking modes. sum adds up the clicks of every day in the range, decay
+// halves the weight of a day's clicks every halfLife hours, and hot divides
+// the clicks by (hours since publication + 2) ^ gravity. in adds up the
+// visits from feed readers and other sites instead of the clicks, and
+// combined adds both, the visits weighted by inWeight.
+const (
+    RANKING_MODE_SUM      = "sum"
+    RANKING_MODE_DECAY    = "decay"
+    RANKING_MODE_HOT      = "hot"
+    RANKING_MODE_IN       = "in"
+    RANKING_MODE_COMBINED = "combined"
+)
+
+// Click streams, each kept in daily and hourly buckets under feed:rank:.
+// The referer stream counts visits per referring site instead of per item.
+const (
+    RANK_STREAM_OUT     = ""
+    RANK_STREAM_IN      = "in"
+    RANK_STREAM_REFERER = "referer"
+)
+
+// GetRankSnapshotKeyname returns the ranking of a window in a snapshot
+// version, over all items or over the items of one category.
+func GetRankSnapshotKeyname(version int, window string, category string) string {
+    keyname := REDISKEY_FEED_RANK_SNAPSHOT_PREFIX + strconv.Itoa(version) + ":" + window
+    if category != "" {
+        return keyname + ":" + category
+    }
+    return keyname
+}
+
+// SetRankSnapshot scores the click buckets of every window into a new
+// snapshot, one ranking for all items and one per category, and then
+// publishes it by moving feed:snapshot:version. Page views only read the
+// published snapshot. The previous snapshot is kept for readers that
+// started before the switch; older ones are deleted.
+func (dm *DataManager) SetRankSnapshot() int {
+    start := time.Now()
+    version, err := dm.Store.IncrCounter(REDISKEY_FEED_SNAPSHOT_ID, 1)
+    if err != nil {
+        dm.Logger.WithFields(SetUpdateLog("ranking")).Error(err.Error())
+        return 0
+    }
+    now := time.Now()
+    conf := GetRankingConfig(dm.UserConfig, "")
+    categories := GetCategories(dm.UserConfig)
+    for _, window := range append([]string{RANK_WINDOW_DAYS}, RANK_WINDOWS...) {
+        buckets := GetRankBuckets(window, dm.UserConfig.Site.ItemDays, now)
+        allrankkey := GetRankSnapshotKeyname(version, window, "")
+        dm.SetRanking(allrankkey, buckets, conf)
+        for _, category := range categories {
+            categoryrankkey := GetRankSnapshotKeyname(version, window, category)
+            if c := GetRankingConfig(dm.UserConfig, category); c != conf {
+                dm.SetRanking(categoryrankkey, buckets, c)
+                dm.Store.FilterRank(categoryrankkey, categoryrankkey, REDISKEY_FEED_TIME_PREFIX + category)
+                continue
+            }
+            dm.Store.FilterRank(categoryrankkey, allrankkey, REDISKEY_FEED_TIME_PREFIX + category)
+        }
+    }
+    previous := dm.GetRankVersion()
+    dm.Store.SetCounter(REDISKEY_FEED_SNAPSHOT_VERSION, version)
+
+    var expired []string
+    for _, keyname := range dm.Store.GetRankKeys() {
+        if strings.HasPrefix(keyname, REDISKEY_FEED_RANK_DAYS_PREFIX) {
+            expired = append(expired, keyname)
+            continue
+        }
+        if !strings.HasPrefix(keyname, REDISKEY_FEED_RANK_SNAPSHOT_PREFIX) {
+            continue
+        }
+        v, err := strconv.Atoi(strings.SplitN(strings.TrimPrefix(keyname, REDISKEY_FEED_RANK_SNAPSHOT_PREFIX), ":", 2)[0])
+        if err == nil && v < previous {
+            expired = append(expired, keyname)
+        }
+    }
+    dm.Store.DeleteRank(expired...)
+
+    fields := SetUpdateLog("ranking")
+    fields["version"] = version
+    fields["categories"] = len(categories)
+    fields["deleted"] = len(expired)
+    fields["elapsed"] = time.Since(start).String()
+    dm.Logger.WithFields(fields).Info("update ranking snapshot")
+    return version
+}
+
+// SetRanking scores the click buckets into dest with the given mode.
+func (dm *DataManager) SetRanking(dest string, buckets []RankBucket, conf ConfigRanking) {
+    var rankkeys []string
+    var weights []float64
+    add := func(stream string, weight float64) {
+        for _, b := range buckets {
+            w := b.Weight * weight
+            if conf.Mode == RANKING_MODE_DECAY {
+                w *= math.Pow(0.5, b.Age / conf.HalfLife)
+            }
+            rankkeys = append(rankkeys, b.Keyname(stream))
+            weights = append(weights, w)
+        }
+    }
+    switch conf.Mode {
+        case RANKING_MODE_IN:
+            add(RANK_STREAM_IN, 1)
+        case RANKING_MODE_COMBINED:
+            add(RANK_STREAM_OUT, 1)
+            add(RANK_STREAM_IN, conf.InWeight)
+        default:
+            add(RANK_STREAM_OUT, 1)
+    }
+    switch conf.Mode {
+        case RANKING_MODE_HOT:
+            dm.Store.UnionRank(dest, rankkeys, weights)
+            scores := dm.Store.GetRankScores(dest)
+            var keys []string
+            for keyname := range scores {
+                keys = append(keys, keyname)
+            }
+            now := time.Now()
+            for i, pubdate := range dm.Store.GetItemsField(keys, "pub_date") {
+                age := now.Sub(GetFeedDateTime(pubdate)).Hours()
+                if age < 0 {
+                    age = 0
+                }
+                scores[keys[i]] /= math.Pow(age + 2, conf.Gravity)
+            }
+            dm.Store.SetRank(dest, scores)
+        default:
+            dm.Store.UnionRank(dest, rankkeys, weights)
+    }
+}
+
+// GetRankBuckets returns the click buckets of a window, newest first. The
+// oldest hourly bucket only counts for the part of it that is still within
+// the window; daily windows include today so far.
+func GetRankBuckets(window string, itemDays int, now time.Time) []RankBucket {
+    var result []RankBucket
+    hours, days := ParseRankWindow(window)
+    if window == RANK_WINDOW_DAYS {
+        days = itemDays
+    }
+    hour := now.Truncate(time.Hour)
+    for i := 0; i <= hours && hours > 0; i++ {
+        t := hour.Add(time.Duration(-i) * time.Hour)
+        b := RankBucket{t, true, now.Sub(t).Hours(), 1}
+        if i == hours {
+            b.Weight = 1 - float64(now.Minute()) / 60
+        }
+        result = append(result, b)
+    }
+    for i := 0; i < days; i++ {
+        t := now.AddDate(0, 0, -i)
+        result = append(result, RankBucket{t, false, float64(i * 24), 1})
+    }
+    return result
+}
+
+// ParseRankWindow returns the length of a window in RANK_WINDOWS in hours
+// or in days, both 0 for an unknown window.
+func ParseRankWindow(window string) (int, int) {
+    for _, w := range RANK_WINDOWS {
+        if w != window {
+            continue
+        }
+        n, _ := strconv.Atoi(window[:len(window) - 1])
+        if strings.HasSuffix(window, "h") {
+            return n, 0
+        }
+        return 0, n
+    }
+    return 0, 0
+}
+
+func IsRankWindow(window string) bool {
+    hours, days := ParseRankWindow(window)
+    return hours > 0 || days > 0
+}
+
+// GetRankKeyname returns the click bucket of a stream for the day of t, or
+// for its hour with hourly, e.g. feed:rank:20151001 or
+// feed:rank:in:hour:2015100112.
+func GetRankKeyname(stream string, t time.Time, hourly bool) string {
+    keyname := REDISKEY_FEED_RANK_PREFIX
+    if stream != "" {
+        keyname += stream + ":"
+    }
+    if hourly {
+        return keyname + "hour:" + t.Format(GetHourFormat())
+    }
+    return keyname + t.Format(GetDateFormat())
+}
+
+// ParseRankKeyname returns the time of a click bucket and whether it is
+// hourly; ok is false for the other keys under feed:rank:.
+func ParseRankKeyname(keyname string) (t time.Time, hourly bool, ok bool) {
+    parts := strings.Split(strings.TrimPrefix(keyname, REDISKEY_FEED_RANK_PREFIX), ":")
+    format := GetDateFormat()
+    if len(parts) > 1 && parts[len(parts) - 2] == "hour" {
+        hourly = true
+        format = GetHourFormat()
+    }
+    t, err := time.ParseInLocation(format, parts[len(parts) - 1], time.Local)
+    return t, hourly, err == nil
+}
+
+func GetHourFormat() string {
+    return "2006010215"
+}
+
+// GetRankingConfig returns the ranking settings of a category, falling
+// back to the site wide ranking settings and then to the defaults.
+func GetRankingConfig(userconf *UserConfig, category string) ConfigRanking {
+    conf := userconf.Ranking
+    for _, c := range userconf.Feed.Category {
+        if c.Dir != category || category == "" {
+            continue
+        }
+        if c.Ranking.Mode != "" {
+            conf.Mode = c.Ranking.Mode
+        }
+        if c.Ranking.HalfLife > 0 {
+            conf.HalfLife = c.Ranking.HalfLife
+        }
+        if c.Ranking.Gravity > 0 {
+            conf.Gravity = c.Ranking.Gravity
+        }
+        if c.Ranking.InWeight > 0 {
+            conf.InWeight = c.Ranking.InWeight
+        }
+    }
+    if conf.Mode == "" {
+        conf.Mode = RANKING_MODE_SUM
+    }
+    if conf.HalfLife <= 0 {
+        conf.HalfLife = DEFAULT_RANKING_HALF_LIFE
+    }
+    if conf.Gravity <= 0 {
+        conf.Gravity = DEFAULT_RANKING_GRAVITY
+    }
+    if conf.InWeight <= 0 {
+        conf.InWeight = DEFAULT_RANKING_IN_WEIGHT
+    }
+    return conf
+}
+
+// GetRankVersion returns the published snapshot version, 0 before the
+// first snapshot has been built.
+func (dm *DataManager) GetRankVersion() int {
+    return dm.Store.GetCounter(REDISKEY_FEED_SNAPSHOT_VERSION)
+}
+
+func GetRankingInterval(userconf *UserConfig) time.Duration {
+    interval := userconf.Schedule.RankingInterval
+    if interval <= 0 {
+        interval = DEFAULT_RANKING_INTERVAL
+    }
+    return time.Duration(interval) * time.Minute
+}
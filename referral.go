@@ -0,0 +1,64 @@
+package main
+
+import (
+    "net/url"
+    "sort"
+    "strings"
+    "time"
+)
+
+const REFERRAL_DIRECT = "direct"
+
+type ReferralStat struct {
+    Source string         `json:"source"`
+    Count  int            `json:"count"`
+    Daily  map[string]int `json:"daily"`
+}
+
+type byReferralCount []ReferralStat
+
+func (a byReferralCount) Len() int      { return len(a) }
+func (a byReferralCount) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byReferralCount) Less(i, j int) bool {
+    if a[i].Count != a[j].Count {
+        return a[i].Count > a[j].Count
+    }
+    return a[i].Source < a[j].Source
+}
+
+// GetReferralSource returns the referring site of a visit, the host of
+// the Referer, or REFERRAL_DIRECT for visits without one such as most feed
+// readers.
+func GetReferralSource(referer string) string {
+    u, err := url.Parse(referer)
+    if err != nil || u.Host == "" {
+        return REFERRAL_DIRECT
+    }
+    return strings.ToLower(u.Host)
+}
+
+// GetReferralStats returns the visits per referring site over the last
+// days days, most visits first.
+func (dm *DataManager) GetReferralStats(days int) []ReferralStat {
+    stats := make(map[string]*ReferralStat)
+    now := time.Now()
+    for i := 0; i < days; i++ {
+        t := now.AddDate(0, 0, -i)
+        day := t.Format(GetDateFormat())
+        for source, score := range dm.Store.GetRankScores(GetRankKeyname(RANK_STREAM_REFERER, t, false)) {
+            stat, ok := stats[source]
+            if !ok {
+                stat = &ReferralStat{Source: source, Daily: make(map[string]int)}
+                stats[source] = stat
+            }
+            stat.Count += int(score)
+            stat.Daily[day] = int(score)
+        }
+    }
+    result := []ReferralStat{}
+    for _, stat := range stats {
+        result = append(result, *stat)
+    }
+    sort.Sort(byReferralCount(result))
+    return result
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "strconv"
+    "strings"
+    "github.com/Sirupsen/logrus"
+)
+
+type RepairReport struct {
+    Items          int
+    MaxId          int
+    FixedIds       int
+    OrphanLinks    int
+    IndexedLinks   int
+    CategoryFixes  int
+    Stories        int
+    CounterUpdated bool
+}
+
+// RepairItems cleans up after the old SCARD based ID allocation, which
+// could give two items the same ID so the later one overwrote the first.
+// A collided key holds a hash whose link differs from the one feed:links
+// recorded for the key. That recorded link lost its item and is removed
+// from feed:exists, unless another item still uses it, so the next update
+// can store the item again under a fresh ID. Collisions from before
+// feed:links left no record, so a feed:exists link that no live item
+// carries is removed as well when an entry of channel still lists it; links
+// of items that merely expired are left to the retention job. Category time
+// indexes that still point at an overwritten key are dropped and the feed:id
+// counter is moved past the highest ID in use. Items stored before
+// feed:links get their link recorded, so the retention job can remove it
+// once they expire, and items stored before story clustering become stories
+// of their own.
+func (dm *DataManager) RepairItems(channel []Channel) RepairReport {
+    report := RepairReport{}
+    links := make(map[string]bool)
+    categories := make(map[string]string)
+    var collided []string
+    for _, keyname := range dm.Store.GetItemKeys() {
+        item, ok := dm.Store.GetItem(keyname)
+        if !ok {
+            continue
+        }
+        id, err := strconv.Atoi(strings.TrimPrefix(keyname, REDISKEY_FEED_ITEM_PREFIX))
+        if err != nil {
+            continue
+        }
+        report.Items++
+        if id > report.MaxId {
+            report.MaxId = id
+        }
+        if item.Id != id {
+            dm.Store.SetItemField(keyname, "id", id)
+            report.FixedIds++
+        }
+        links[item.Link] = true
+        links[item.CanonicalLink] = true
+        itemlinks := GetItemExistsLinks(item)
+        indexed := dm.Store.GetItemLink(keyname)
+        switch {
+            case len(indexed) == 0:
+                dm.Store.SetItemLink(keyname, itemlinks)
+                report.IndexedLinks++
+            case indexed[0] != itemlinks[0]:
+                collided = append(collided, indexed...)
+                dm.Store.SetItemLink(keyname, itemlinks)
+            default:
+                for _, link := range indexed {
+                    links[link] = true
+                }
+        }
+        categories[keyname] = item.Category
+        if IsClusterEnabled(dm.UserConfig) && dm.SetStory(keyname, item) {
+            report.Stories++
+        }
+    }
+    var orphans []string
+    for _, link := range collided {
+        if !links[link] && dm.Store.IsItemExists(link) {
+            orphans = append(orphans, link)
+            links[link] = true
+        }
+    }
+    entries := dm.GetChannelLinks(channel)
+    for _, link := range dm.Store.GetItemLinks() {
+        if !links[link] && entries[link] {
+            orphans = append(orphans, link)
+        }
+    }
+    dm.Store.RemoveLinks(orphans...)
+    report.OrphanLinks = len(orphans)
+    for _, c := range dm.UserConfig.Feed.Category {
+        categorykeyname := REDISKEY_FEED_TIME_PREFIX + c.Dir
+        members := dm.Store.GetIndexRange(categorykeyname, math.Inf(-1), math.Inf(1), 0, -1)
+        for _, keyname := range members {
+            if category, ok := categories[keyname]; ok && category != c.Dir {
+                dm.Store.RemoveIndex(keyname, categorykeyname)
+                report.CategoryFixes++
+            }
+        }
+    }
+    if dm.Store.GetCounter(REDISKEY_FEED_ID) < report.MaxId {
+        dm.Store.SetCounter(REDISKEY_FEED_ID, report.MaxId)
+        report.CounterUpdated = true
+    }
+    dm.Logger.WithFields(report.Fields()).Info("repair items")
+    return report
+}
+
+// GetChannelLinks fetches channel without validators and returns the raw and
+// canonical links of its entries.
+func (dm *DataManager) GetChannelLinks(channel []Channel) map[string]bool {
+    result := make(map[string]bool)
+    canonicalizer := NewCanonicalizer(dm.UserConfig.Feed.Canonical, dm.UserConfig.Feed.Timeout)
+    fetcher := NewFeedFetcher(dm.UserConfig.Feed)
+    for fetched := range fetcher.Fetch(channel, func(Channel) ChannelState { return ChannelState{} }) {
+        if fetched.Err != nil {
+            dm.Logger.WithFields(SetUpdateLog("repair")).Error(fetched.Err.Error())
+            continue
+        }
+        for _, entrie := range fetched.Feed.Entries {
+            result[entrie.Link] = true
+            result[canonicalizer.Canonicalize(entrie.Link)] = true
+        }
+    }
+    return result
+}
+
+func (r RepairReport) Fields() logrus.Fields {
+    fields := SetUpdateLog("repair")
+    fields["items"] = r.Items
+    fields["maxId"] = r.MaxId
+    fields["fixedIds"] = r.FixedIds
+    fields["orphanLinks"] = r.OrphanLinks
+    fields["indexedLinks"] = r.IndexedLinks
+    fields["categoryFixes"] = r.CategoryFixes
+    fields["stories"] = r.Stories
+    fields["counterUpdated"] = r.CounterUpdated
+    return fields
+}
+
+func (r RepairReport) String() string {
+    return fmt.Sprintf("items: %d, max id: %d, fixed ids: %d, orphan links: %d, indexed links: %d, category fixes: %d, stories: %d, counter updated: %t",
+        r.Items, r.MaxId, r.FixedIds, r.OrphanLinks, r.IndexedLinks, r.CategoryFixes, r.Stories, r.CounterUpdated)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+)
+
+// A legacy collision: the item of http://example.com/3 overwrote the one of
+// http://example.com/1 under the same ID before feed:links was recorded,
+// so only feed:exists still knows the first link.
+func SeedTestCollision(t *testing.T, store Store) {
+    now := time.Now()
+    first := ItemRedis{Title: "first", Link: "http://example.com/1", PubDate: now.Format(time.RFC1123Z)}
+    if _, err := store.AddItem(first, []string{first.Link}, GetDateTimeScore(now), now.AddDate(0, 0, 1), []string{REDISKEY_FEED_TIME}); err != nil {
+        t.Fatal(err)
+    }
+    second := ItemRedis{Title: "second", Link: "http://example.com/3", PubDate: now.Format(time.RFC1123Z)}
+    if _, err := store.AddItem(second, []string{second.Link}, GetDateTimeScore(now), now.AddDate(0, 0, -1), nil); err != nil {
+        t.Fatal(err)
+    }
+    store.SetItemField(REDISKEY_FEED_ITEM_PREFIX + "1", "title", second.Title)
+    store.SetItemField(REDISKEY_FEED_ITEM_PREFIX + "1", "link", second.Link)
+    store.RemoveItemLink(REDISKEY_FEED_ITEM_PREFIX + "1", nil)
+    store.RemoveItemLink(REDISKEY_FEED_ITEM_PREFIX + "2", nil)
+}
+
+func TestRepairItemsCollision(t *testing.T) {
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprint(w, testRss2)
+    }))
+    defer server.Close()
+    channel := []Channel{{Url: server.URL, Category: "news"}}
+    for name, store := range GetTestStores(t) {
+        dm := NewTestDataManager(store)
+        SeedTestCollision(t, store)
+        report := dm.RepairItems(channel)
+        if report.OrphanLinks != 1 || report.IndexedLinks != 1 {
+            t.Errorf("%s: report %s", name, report)
+        }
+        if dm.IsItemExists("http://example.com/1") || !dm.IsItemExists("http://example.com/3") {
+            t.Errorf("%s: feed:exists = %v", name, store.GetItemLinks())
+        }
+        dm.SetFeed(channel)
+        if n := dm.GetChannelState(channel[0]).NewItemCount; n != 2 {
+            t.Errorf("%s: stored %d items again, want 2", name, n)
+        }
+        if link := NewCanonicalizer(dm.UserConfig.Feed.Canonical, 0).Canonicalize("http://example.com/1"); !dm.IsItemExists(link) {
+            t.Errorf("%s: lost item was not stored again", name)
+        }
+    }
+}
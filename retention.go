@@ -0,0 +1,172 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "time"
+    "github.com/Sirupsen/logrus"
+)
+
+const DEFAULT_RETENTION_INTERVAL = 60
+
+type PruneReport struct {
+    DryRun       bool
+    Items        int
+    Links        int
+    IndexEntries int
+    RankEntries  int
+    RankKeys     int
+    OrphanLinks  int
+}
+
+// PruneItems removes items whose hash has expired from every index that
+// still refers to them: feed:exists, the time and story indexes, the
+// cluster bookkeeping, the rank zsets and the search index. Daily click
+// buckets older than itemExpire days and hourly ones older than
+// DEFAULT_RANK_HOUR_DAYS days are dropped as well. With dryRun nothing is
+// written and the report tells what would have been pruned. The link of
+// an expired item is taken from feed:links, which RepairItems fills for
+// items stored before it existed.
+func (dm *DataManager) PruneItems(dryRun bool) PruneReport {
+    report := PruneReport{DryRun: dryRun}
+    cutoff := time.Now().AddDate(0, 0, dm.UserConfig.Site.ItemExpire * -1)
+    candidates := dm.Store.GetIndexRange(REDISKEY_FEED_TIME, math.Inf(-1), GetDateTimeScore(cutoff), 0, -1)
+    var expired []string
+    for _, keyname := range candidates {
+        if !dm.Store.IsKeyExists(keyname) {
+            expired = append(expired, keyname)
+        }
+    }
+    report.Items = len(expired)
+
+    var indexes []string
+    indexes = append(indexes, REDISKEY_FEED_TIME, REDISKEY_FEED_STORY)
+    for _, category := range GetCategories(dm.UserConfig) {
+        indexes = append(indexes, REDISKEY_FEED_TIME_PREFIX + category, REDISKEY_FEED_STORY + ":" + category)
+    }
+    var rankkeys []string
+    hourcutoff := time.Now().AddDate(0, 0, DEFAULT_RANK_HOUR_DAYS * -1)
+    for _, keyname := range dm.Store.GetRankKeys() {
+        t, hourly, ok := ParseRankKeyname(keyname)
+        if ok && (hourly && t.Before(hourcutoff) || !hourly && t.Before(cutoff)) {
+            report.RankKeys++
+            if !dryRun {
+                dm.Store.DeleteRank(keyname)
+            }
+            continue
+        }
+        rankkeys = append(rankkeys, keyname)
+    }
+
+    for _, keyname := range expired {
+        links := dm.Store.GetItemLink(keyname)
+        report.Links += len(links)
+        for _, index := range indexes {
+            if _, ok := dm.Store.GetIndexScore(index, keyname); ok {
+                report.IndexEntries++
+            }
+        }
+        for _, rankkey := range rankkeys {
+            if _, ok := dm.Store.GetRankScore(rankkey, keyname); ok {
+                report.RankEntries++
+            }
+        }
+        if dryRun {
+            continue
+        }
+        dm.Store.RemoveItemLink(keyname, links)
+        dm.Store.DeleteCounter(REDISKEY_FEED_CLUSTER_SIZE_PREFIX + keyname, REDISKEY_FEED_CLUSTER_PREFIX + keyname)
+        dm.Store.RemoveIndex(keyname, indexes...)
+        dm.Store.RemoveRank(keyname, rankkeys...)
+        dm.Store.RemoveSearchItem(keyname)
+    }
+    dm.Logger.WithFields(report.Fields()).Info("prune items")
+    return report
+}
+
+// PruneOrphanLinks removes the feed:exists links that neither a live item
+// nor feed:links accounts for. Items that expired before feed:links was
+// recorded left such links behind, so their entries were never stored
+// again. It scans every item, so it is run once by hand rather than by the
+// retention job.
+func (dm *DataManager) PruneOrphanLinks(dryRun bool) int {
+    exists := dm.Store.GetItemLinks()
+    links := make(map[string]bool)
+    for _, keyname := range dm.Store.GetItemKeys() {
+        if item, ok := dm.Store.GetItem(keyname); ok {
+            links[item.Link] = true
+            links[item.CanonicalLink] = true
+        }
+        for _, link := range dm.Store.GetItemLink(keyname) {
+            links[link] = true
+        }
+    }
+    for _, keyname := range dm.Store.GetIndexRange(REDISKEY_FEED_TIME, math.Inf(-1), math.Inf(1), 0, -1) {
+        for _, link := range dm.Store.GetItemLink(keyname) {
+            links[link] = true
+        }
+    }
+    var orphans []string
+    for _, link := range exists {
+        if !links[link] {
+            orphans = append(orphans, link)
+        }
+    }
+    if !dryRun {
+        dm.Store.RemoveLinks(orphans...)
+    }
+    fields := SetUpdateLog("retention")
+    fields["dryRun"] = dryRun
+    fields["orphanLinks"] = len(orphans)
+    dm.Logger.WithFields(fields).Info("prune orphan links")
+    return len(orphans)
+}
+
+// GetCategories returns every category dir used by the navigation or by a
+// channel.
+func GetCategories(userconf *UserConfig) []string {
+    var result []string
+    seen := make(map[string]bool)
+    for _, c := range userconf.Feed.Category {
+        if c.Dir != "" && !seen[c.Dir] {
+            seen[c.Dir] = true
+            result = append(result, c.Dir)
+        }
+    }
+    for _, c := range userconf.Feed.Channel {
+        if c.Category != "" && !seen[c.Category] {
+            seen[c.Category] = true
+            result = append(result, c.Category)
+        }
+    }
+    return result
+}
+
+func GetRetentionInterval(userconf *UserConfig) time.Duration {
+    interval := userconf.Schedule.RetentionInterval
+    if interval <= 0 {
+        interval = DEFAULT_RETENTION_INTERVAL
+    }
+    return time.Duration(interval) * time.Minute
+}
+
+func (r PruneReport) Fields() logrus.Fields {
+    fields := SetUpdateLog("retention")
+    fields["dryRun"] = r.DryRun
+    fields["items"] = r.Items
+    fields["links"] = r.Links
+    fields["indexEntries"] = r.IndexEntries
+    fields["rankEntries"] = r.RankEntries
+    fields["rankKeys"] = r.RankKeys
+    fields["orphanLinks"] = r.OrphanLinks
+    return fields
+}
+
+func (r PruneReport) String() string {
+    prefix := ""
+    if r.DryRun {
+        prefix = "(dry run) "
+    }
+    return fmt.Sprintf("%sexpired items: %d, links: %d, index entries: %d, rank entries: %d, rank keys: %d, orphan links: %d",
+        prefix, r.Items, r.Links, r.IndexEntries, r.RankEntries, r.RankKeys, r.OrphanLinks)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestPruneOrphanLinks(t *testing.T) {
+    for name, store := range GetTestStores(t) {
+        dm := NewTestDataManager(store)
+        now := time.Now()
+        for i, link := range []string{"http://example.com/live", "http://example.com/legacy", "http://example.com/expired"} {
+            expire := now.AddDate(0, 0, 1)
+            if i > 0 {
+                expire = now.AddDate(0, 0, -1)
+            }
+            if _, err := store.AddItem(ItemRedis{Link: link}, []string{link}, GetDateTimeScore(now), expire, []string{REDISKEY_FEED_TIME}); err != nil {
+                t.Fatal(err)
+            }
+        }
+        store.RemoveItemLink(REDISKEY_FEED_ITEM_PREFIX + "2", nil)
+        if n := dm.PruneOrphanLinks(true); n != 1 || !dm.IsItemExists("http://example.com/legacy") {
+            t.Errorf("%s: dry run pruned %d links", name, n)
+        }
+        if n := dm.PruneOrphanLinks(false); n != 1 {
+            t.Errorf("%s: pruned %d links, want 1", name, n)
+        }
+        if dm.IsItemExists("http://example.com/legacy") || !dm.IsItemExists("http://example.com/live") || !dm.IsItemExists("http://example.com/expired") {
+            t.Errorf("%s: feed:exists = %v", name, store.GetItemLinks())
+        }
+    }
+}
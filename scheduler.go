@@ -0,0 +1,151 @@
+package main
+
+import (
+    "runtime/debug"
+    "sync"
+    "time"
+    "github.com/Sirupsen/logrus"
+)
+
+const (
+    DEFAULT_FEED_INTERVAL = 15
+    DEFAULT_DICT_INTERVAL = 1440
+)
+
+type Job struct {
+    Name         string    `json:"name"`
+    Interval     string    `json:"interval"`
+    LastRun      time.Time `json:"lastRun"`
+    LastDuration string    `json:"lastDuration"`
+    NextRun      time.Time `json:"nextRun"`
+    Running      bool      `json:"running"`
+    interval     time.Duration
+    run          func()
+}
+
+type Scheduler struct {
+    mu   sync.Mutex
+    jobs []*Job
+    *logrus.Logger
+}
+
+func NewScheduler(logger *logrus.Logger) *Scheduler {
+    return &Scheduler{Logger: logger}
+}
+
+// AddJob registers f to run every interval. The first run happens as soon
+// as the scheduler starts.
+func (s *Scheduler) AddJob(name string, interval time.Duration, f func()) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.jobs = append(s.jobs, &Job{
+        Name:     name,
+        Interval: interval.String(),
+        NextRun:  time.Now(),
+        interval: interval,
+        run:      f,
+    })
+}
+
+func (s *Scheduler) Start() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, job := range s.jobs {
+        go s.loop(job)
+    }
+}
+
+func (s *Scheduler) loop(job *Job) {
+    for {
+        s.mu.Lock()
+        wait := job.NextRun.Sub(time.Now())
+        s.mu.Unlock()
+        if wait > 0 {
+            time.Sleep(wait)
+        }
+        s.mu.Lock()
+        job.Running = true
+        job.LastRun = time.Now()
+        s.mu.Unlock()
+        s.Logger.WithFields(SetScheduleLog(job.Name)).Info("start job")
+        s.runJob(job)
+        s.mu.Lock()
+        job.Running = false
+        job.LastDuration = time.Since(job.LastRun).String()
+        job.NextRun = job.LastRun.Add(job.interval)
+        if job.NextRun.Before(time.Now()) {
+            job.NextRun = time.Now()
+        }
+        s.mu.Unlock()
+        s.Logger.WithFields(SetScheduleLog(job.Name)).Info("finish job")
+    }
+}
+
+// runJob runs job once. A panic is logged and the job runs again at its
+// next time, so one failing job does not take down the daemon.
+func (s *Scheduler) runJob(job *Job) {
+    defer func() {
+        if err := recover(); err != nil {
+            s.Logger.WithFields(SetScheduleLog(job.Name)).Errorf("panic: %v\n%s", err, debug.Stack())
+        }
+    }()
+    job.run()
+}
+
+// Jobs returns a snapshot of the registered jobs and their run times.
+func (s *Scheduler) Jobs() []Job {
+    result := []Job{}
+    if s == nil {
+        return result
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, job := range s.jobs {
+        result = append(result, *job)
+    }
+    return result
+}
+
+func GetFeedInterval(userconf *UserConfig) time.Duration {
+    interval := userconf.Schedule.FeedInterval
+    if interval <= 0 {
+        interval = DEFAULT_FEED_INTERVAL
+    }
+    return time.Duration(interval) * time.Minute
+}
+
+func GetDictInterval(userconf *UserConfig) time.Duration {
+    interval := userconf.Schedule.DictInterval
+    if interval <= 0 {
+        interval = DEFAULT_DICT_INTERVAL
+    }
+    return time.Duration(interval) * time.Minute
+}
+
+// GetChannelInterval returns the poll interval of a channel, falling back
+// to the global feed interval when the channel has no override.
+func GetChannelInterval(userconf *UserConfig, channel Channel) time.Duration {
+    if channel.Interval > 0 {
+        return time.Duration(channel.Interval) * time.Minute
+    }
+    return GetFeedInterval(userconf)
+}
+
+// GetFeedTickInterval is the shortest of all channel intervals, which is
+// how often the feed job has to wake up to honor every override.
+func GetFeedTickInterval(userconf *UserConfig) time.Duration {
+    result := GetFeedInterval(userconf)
+    for _, v := range userconf.Feed.Channel {
+        if interval := GetChannelInterval(userconf, v); interval < result {
+            result = interval
+        }
+    }
+    return result
+}
+
+func SetScheduleLog(job string) logrus.Fields {
+    return logrus.Fields{
+            "category": "schedule",
+            "job": job,
+        }
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+    "errors"
+    "math"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+    "unicode"
+    "github.com/flosch/pongo2"
+    "github.com/zenazn/goji/web"
+)
+
+var ErrInvalidDate = errors.New("invalid date, use YYYYMMDD")
+
+// GetSearchTokens splits text into the tokens of the search index. Words
+// of ASCII letters and digits are kept whole; other runs of letters, such
+// as Japanese, have no word boundaries and become bigrams, a single letter
+// standing on its own. Full-width ASCII is folded to half-width.
+func GetSearchTokens(text string) []string {
+    var result []string
+    seen := make(map[string]bool)
+    add := func(token string) {
+        if !seen[token] {
+            seen[token] = true
+            result = append(result, token)
+        }
+    }
+    var run []rune
+    ascii := false
+    flush := func() {
+        if ascii || len(run) == 1 {
+            add(string(run))
+        } else {
+            for i := 0; i + 1 < len(run); i++ {
+                add(string(run[i:i + 2]))
+            }
+        }
+        run = run[:0]
+    }
+    for _, r := range strings.ToLower(text) {
+        if r >= '！' && r <= '～' {
+            r -= '！' - '!'
+        }
+        if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+            if len(run) > 0 {
+                flush()
+            }
+            continue
+        }
+        if len(run) > 0 && (r < unicode.MaxASCII) != ascii {
+            flush()
+        }
+        ascii = r < unicode.MaxASCII
+        run = append(run, r)
+    }
+    if len(run) > 0 {
+        flush()
+    }
+    return result
+}
+
+// GetSearchIndexTokens returns the tokens an item is indexed by: those of
+// GetSearchTokens and every non-ASCII letter on its own, so a query of a
+// single kanji finds the words containing it.
+func GetSearchIndexTokens(text string) []string {
+    result := GetSearchTokens(text)
+    seen := make(map[string]bool)
+    for _, token := range result {
+        seen[token] = true
+    }
+    for _, r := range strings.ToLower(text) {
+        if r >= '！' && r <= '～' {
+            continue
+        }
+        if r < unicode.MaxASCII || !unicode.IsLetter(r) && !unicode.IsDigit(r) || seen[string(r)] {
+            continue
+        }
+        seen[string(r)] = true
+        result = append(result, string(r))
+    }
+    return result
+}
+
+func GetSearchText(i ItemRedis) string {
+    return strings.Join(append([]string{i.Title, i.Content, i.FeedTitle}, GetItemTags(i)...), "\n")
+}
+
+// GetSearchIndexes returns the indexes an item must be in to match query:
+// one per token and the time index of category.
+func GetSearchIndexes(query string, category string) []string {
+    var result []string
+    for _, token := range GetSearchTokens(query) {
+        result = append(result, REDISKEY_SEARCH_TOKEN_PREFIX + token)
+    }
+    if len(result) > 0 && category != "" {
+        result = append(result, REDISKEY_FEED_TIME_PREFIX + category)
+    }
+    return result
+}
+
+func (dm *DataManager) SetSearchItem(keyname string, i ItemRedis, score float64) {
+    tokens := append(GetSearchIndexTokens(GetSearchText(i)), GetTagTokens(i)...)
+    if err := dm.Store.AddSearchItem(keyname, tokens, score); err != nil {
+        dm.Logger.WithFields(SetUpdateLog("search")).Error(err.Error())
+    }
+}
+
+// SetSearchIndex indexes every stored item again, for items stored before
+// the search index existed.
+func (dm *DataManager) SetSearchIndex() int {
+    count := 0
+    for _, keyname := range dm.Store.GetItemKeys() {
+        item, ok := dm.Store.GetItem(keyname)
+        if !ok {
+            continue
+        }
+        dm.Store.RemoveSearchItem(keyname)
+        dm.SetSearchItem(keyname, item, GetDateTimeScore(GetFeedDateTime(item.PubDate)))
+        count++
+    }
+    dm.Logger.WithFields(SetUpdateLog("search")).Info("index " + strconv.Itoa(count) + " items")
+    return count
+}
+
+// ParseSearchDate turns a YYYYMMDD date into the first second of the day,
+// or the last one for the end of a range. An empty date is unbounded.
+func ParseSearchDate(text string, end bool) (float64, error) {
+    if text == "" {
+        if end {
+            return math.Inf(1), nil
+        }
+        return math.Inf(-1), nil
+    }
+    t, err := time.ParseInLocation(GetDateFormat(), text, time.Local)
+    if err != nil {
+        return 0, ErrInvalidDate
+    }
+    if end {
+        t = t.AddDate(0, 0, 1).Add(-time.Second)
+    }
+    return GetDateTimeScore(t), nil
+}
+
+func ParseSearchRange(r *http.Request) (float64, float64, error) {
+    min, err := ParseSearchDate(r.URL.Query().Get("from"), false)
+    if err != nil {
+        return 0, 0, err
+    }
+    max, err := ParseSearchDate(r.URL.Query().Get("to"), true)
+    return min, max, err
+}
+
+func (dm *DataManager) GetSearchItem(query string, category string, min float64, max float64, offset int, count int) []Item {
+    indexes := GetSearchIndexes(query, category)
+    if len(indexes) == 0 {
+        return nil
+    }
+    return dm.GetItems(dm.Store.SearchItems(indexes, min, max, offset, count))
+}
+
+// GetCursorSearchItem pages through search results like GetCursorFeedItem.
+func (dm *DataManager) GetCursorSearchItem(query string, category string, min float64, max float64, cursor string, count int) ([]Item, string, error) {
+    indexes := GetSearchIndexes(query, category)
+    if len(indexes) == 0 {
+        return nil, "", nil
+    }
+    offset := 0
+    if cursor != "" {
+        var err error
+        if max, offset, err = DecodeCursor(cursor); err != nil {
+            return nil, "", err
+        }
+    }
+    keys := dm.Store.SearchItems(indexes, min, max, offset, count)
+    next := ""
+    if len(keys) == count {
+        next = dm.GetNextCursor(REDISKEY_FEED_TIME, keys, max, offset)
+    }
+    return dm.GetItems(keys), next, nil
+}
+
+func (cntr Controller) Search(c web.C, w http.ResponseWriter, r *http.Request) {
+    tpl, err := pongo2.FromFile("main.j2")
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    pagenum, err := strconv.Atoi(r.URL.Query().Get("p"))
+    if err != nil || pagenum < 1 {
+        pagenum = 1;
+    }
+    query := r.URL.Query().Get("q")
+    category := r.URL.Query().Get("category")
+    if !cntr.IsCategory(category) {
+        category = ""
+    }
+    min, max, err := ParseSearchRange(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    count := cntr.UserConfig.Site.PageNewItemCount
+    items := cntr.GetSearchItem(query, category, min, max, (pagenum - 1) * count, count)
+    tpl.ExecuteWriter(pongo2.Context{"items": items, "p": pagenum, "q": query, "category": category, "windows": RANK_WINDOWS, "token": cntr.Filter.GetTokenFunc(r)}, w)
+}
+
+func (cntr Controller) ApiSearch(c web.C, w http.ResponseWriter, r *http.Request) {
+    query := r.URL.Query().Get("q")
+    if len(GetSearchTokens(query)) == 0 {
+        WriteApiError(w, http.StatusBadRequest, "missing query q")
+        return
+    }
+    category := r.URL.Query().Get("category")
+    if category != "" && !cntr.IsCategory(category) {
+        WriteApiError(w, http.StatusNotFound, "unknown category " + category)
+        return
+    }
+    min, max, err := ParseSearchRange(r)
+    if err != nil {
+        WriteApiError(w, http.StatusBadRequest, err.Error())
+        return
+    }
+    items, next, err := cntr.GetCursorSearchItem(query, category, min, max, r.URL.Query().Get("cursor"), GetApiCount(r, cntr.UserConfig.Site.PageNewItemCount))
+    if err != nil {
+        WriteApiError(w, http.StatusBadRequest, err.Error())
+        return
+    }
+    WriteApiJson(w, http.StatusOK, NewApiList(items, next))
+}
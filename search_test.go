@@ -0,0 +1,59 @@
+package main
+
+import (
+    "math"
+    "sort"
+    "testing"
+)
+
+func TestGetSearchTokens(t *testing.T) {
+    tests := []struct {
+        text string
+        want []string
+    }{
+        {"iPhone 6s", []string{"iphone", "6s"}},
+        {"ＧＯＯＧＬＥ", []string{"google"}},
+        {"東京タワー", []string{"東京", "京タ", "タワ", "ワー"}},
+        {"東", []string{"東"}},
+        {"東 京", []string{"東", "京"}},
+        {"東京iPhone", []string{"東京", "iphone"}},
+    }
+    for _, test := range tests {
+        if got := GetSearchTokens(test.text); !EqualStrings(got, test.want) {
+            t.Errorf("GetSearchTokens(%q) = %v, want %v", test.text, got, test.want)
+        }
+    }
+}
+
+func TestGetSearchIndexTokens(t *testing.T) {
+    got := GetSearchIndexTokens("東京の東 iPhone")
+    want := []string{"東京", "京の", "の東", "iphone", "東", "京", "の"}
+    if !EqualStrings(got, want) {
+        t.Errorf("GetSearchIndexTokens = %v, want %v", got, want)
+    }
+}
+
+func TestGetSearchItem(t *testing.T) {
+    for name, store := range GetTestStores(t) {
+        dm := NewTestDataManager(store)
+        dm.SetFeedItems(Channel{Category: "news"}, NewTestFeed("東京で地震", "東北の天気", "大阪の iPhone 発売"), nil, NewCanonicalizer(dm.UserConfig.Feed.Canonical, 0))
+        tests := []struct {
+            query string
+            want  []string
+        }{
+            {"東", []string{"東北の天気", "東京で地震"}},
+            {"東京", []string{"東京で地震"}},
+            {"天", []string{"東北の天気"}},
+            {"iphone 大阪", []string{"大阪の iPhone 発売"}},
+            {"京都", nil},
+        }
+        for _, test := range tests {
+            got := GetItemTitles(dm.GetSearchItem(test.query, "", math.Inf(-1), math.Inf(1), 0, 10))
+            sort.Strings(got)
+            sort.Strings(test.want)
+            if !EqualStrings(got, test.want) {
+                t.Errorf("%s: search %q = %v, want %v", name, test.query, got, test.want)
+            }
+        }
+    }
+}
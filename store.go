@@ -0,0 +1,213 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "strconv"
+    "strings"
+    "time"
+    "github.com/garyburd/redigo/redis"
+)
+
+// Store is the persistence layer behind DataManager. Keys keep the Redis
+// layout (feed:item:N, feed:time:<category>, feed:rank:YYYYMMDD,
+// dict:item:<word>) so every backend shares the same names and semantics.
+type Store interface {
+    ItemStore
+    ChannelStore
+    IndexStore
+    RankingStore
+    DictStore
+    CounterStore
+    VisitorStore
+    SearchStore
+    Ping() error
+    Close() error
+}
+
+type ItemStore interface {
+    // AddItem allocates the next ID from the feed:id counter and stores
+    // the item, its existence links and its time index entries in one step.
+    AddItem(item ItemRedis, links []string, score float64, expire time.Time, indexes []string) (int, error)
+    GetItem(keyname string) (ItemRedis, bool)
+    GetItemKeys() []string
+    GetItemsField(keynames []string, field string) []string
+    SetItemField(keyname string, field string, value interface{}) error
+    IncrItemField(keyname string, field string, n int) error
+    IsKeyExists(keyname string) bool
+    IsItemExists(link string) bool
+    GetItemLinks() []string
+    // GetItemLink returns the links feed:links recorded for an item, the
+    // one GetItemExistsLink picks first.
+    GetItemLink(keyname string) []string
+    // SetItemLink records the links of an item in feed:links.
+    SetItemLink(keyname string, links []string) error
+    // RemoveItemLink forgets the links of an expired item.
+    RemoveItemLink(keyname string, links []string) error
+    RemoveLinks(links ...string) error
+}
+
+type ChannelStore interface {
+    GetChannelState(url string) ChannelState
+    SetChannelState(state ChannelState) error
+}
+
+// IndexStore keeps the time indexes (feed:time, feed:time:<category>,
+// feed:story) that map item keys to their publication time.
+type IndexStore interface {
+    AddIndex(index string, score float64, keyname string) error
+    RemoveIndex(keyname string, indexes ...string) error
+    GetIndexScore(index string, keyname string) (float64, bool)
+    // GetIndexRange returns the members scored within [min, max], highest
+    // first, skipping offset and returning at most count (-1 for all).
+    GetIndexRange(index string, min float64, max float64, offset int, count int) []string
+}
+
+// RankingStore keeps the click rankings under feed:rank:.
+type RankingStore interface {
+    IncrRank(rankkey string, keyname string, n float64) error
+    // UnionRank stores the sum of rankkeys into dest, each multiplied by
+    // its weight. nil weights count every key once.
+    UnionRank(dest string, rankkeys []string, weights []float64) error
+    // FilterRank stores into dest the scores in rankkey of the members of
+    // index.
+    FilterRank(dest string, rankkey string, index string) error
+    // GetRankRange returns members by rank, highest first, stop inclusive.
+    GetRankRange(rankkey string, start int, stop int) []string
+    GetRankScore(rankkey string, keyname string) (float64, bool)
+    GetRankScores(rankkey string) map[string]float64
+    // SetRank replaces rankkey with scores.
+    SetRank(rankkey string, scores map[string]float64) error
+    GetRankKeys() []string
+    RemoveRank(keyname string, rankkeys ...string) error
+    DeleteRank(rankkeys ...string) error
+}
+
+// DictStore keeps the dictionary words in dict:exists, their details in
+// dict:item:<word> and the words of each dictionary in dict:words:<dict>.
+type DictStore interface {
+    // AddDictItem adds word to the dictionary of item. Like
+    // ReplaceDictItems it leaves the shown details of words another
+    // dictionary lists alone.
+    AddDictItem(word string, item DictItemRedis) error
+    // ReplaceDictItems replaces every word of dict with items in one step.
+    // Each dictionary keeps its own details of a word under dict:entry:,
+    // while dict:item: holds the details shown. Words the dict:words set
+    // of another dictionary lists are not overwritten, and when dict drops
+    // such a word its details are rewritten from that dictionary's entry.
+    ReplaceDictItems(dict string, items map[string]DictItemRedis) error
+    GetDictWords() []string
+    GetDictItem(word string) DictItemRedis
+}
+
+type CounterStore interface {
+    IncrCounter(key string, n int) (int, error)
+    GetCounter(key string) int
+    SetCounter(key string, n int) error
+    DeleteCounter(keys ...string) error
+}
+
+// VisitorStore remembers which visitors were counted for a key, like a
+// HyperLogLog in Redis.
+type VisitorStore interface {
+    // AddVisitor reports whether visitor is new to key. The key is dropped
+    // at expire.
+    AddVisitor(key string, visitor string, expire time.Time) (bool, error)
+}
+
+// SearchStore keeps the full-text index: a time index per token under
+// search:token:<token> and the tokens of each item under
+// search:item:<keyname>, so an item can be dropped from all of them.
+type SearchStore interface {
+    AddSearchItem(keyname string, tokens []string, score float64) error
+    RemoveSearchItem(keyname string) error
+    // SearchItems returns the members found in every index, scored within
+    // [min, max], highest first, like GetIndexRange.
+    SearchItems(indexes []string, min float64, max float64, offset int, count int) []string
+}
+
+const (
+    STORAGE_REDIS  = "redis"
+    STORAGE_MEMORY = "memory"
+    STORAGE_BOLT   = "bolt"
+)
+
+func NewStore(userconf *UserConfig, execdir string) (Store, error) {
+    switch userconf.Storage.Driver {
+        case "", STORAGE_REDIS:
+            return NewRedisStore(userconf.Redis), nil
+        case STORAGE_MEMORY:
+            return NewMemoryStore(), nil
+        case STORAGE_BOLT:
+            path := userconf.Storage.Path
+            if len(path) == 0 {
+                path = execdir + DEFAULT_BOLT_FILE
+            }
+            return NewBoltStore(path)
+    }
+    return nil, fmt.Errorf("unknown storage driver %s", userconf.Storage.Driver)
+}
+
+// GetDateTimeScore turns a time into the index score used by the time
+// indexes, e.g. 20151001123000.
+func GetDateTimeScore(t time.Time) float64 {
+    score, _ := strconv.ParseFloat(t.Format(GetDateTimeFormat()), 64)
+    return score
+}
+
+// ParseScore reads a score bound such as "20151001000000" or "-inf".
+func ParseScore(text string) float64 {
+    switch text {
+        case "+inf", "inf":
+            return math.Inf(1)
+        case "-inf":
+            return math.Inf(-1)
+    }
+    score, _ := strconv.ParseFloat(text, 64)
+    return score
+}
+
+func FormatScore(score float64) string {
+    switch {
+        case math.IsInf(score, 1):
+            return "+inf"
+        case math.IsInf(score, -1):
+            return "-inf"
+    }
+    return strconv.FormatFloat(score, 'f', -1, 64)
+}
+
+// flattenFields and scanFields convert between structs tagged with redis
+// field names and plain field maps, so non-Redis backends store the same
+// fields as the Redis hashes.
+func flattenFields(v interface{}) map[string]string {
+    args := redis.Args{}.AddFlat(v)
+    result := make(map[string]string)
+    for i := 0; i + 1 < len(args); i += 2 {
+        result[fmt.Sprint(args[i])] = fmt.Sprint(args[i + 1])
+    }
+    return result
+}
+
+func scanFields(fields map[string]string, v interface{}) {
+    var values []interface{}
+    for k, f := range fields {
+        values = append(values, []byte(k), []byte(f))
+    }
+    redis.ScanStruct(values, v)
+}
+
+// JoinItemLinks encodes the links of an item as one feed:links value; links
+// never contain spaces.
+func JoinItemLinks(links []string) string {
+    return strings.Join(links, " ")
+}
+
+func SplitItemLinks(value string) []string {
+    return strings.Fields(value)
+}
+
+// GetDictEntryKeyname returns the key of the details dict stored for word.
+func GetDictEntryKeyname(dict string, word string) string {
+    return REDISKEY_DICT_ENTRY_PREFIX + dict + ":" + word
+}
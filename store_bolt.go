@@ -0,0 +1,818 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "math"
+    "strconv"
+    "strings"
+    "time"
+    bolt "go.etcd.io/bbolt"
+)
+
+const (
+    DEFAULT_BOLT_FILE    = "colle.db"
+    DEFAULT_BOLT_TIMEOUT = 5
+)
+
+// Top level buckets. Every Redis key becomes a nested bucket named after
+// the key inside the bucket of its type, so feed:item:1 is the bucket
+// hash/feed:item:1 holding the item fields.
+var (
+    BOLT_BUCKET_HASH    = []byte("hash")
+    BOLT_BUCKET_EXPIRE  = []byte("expire")
+    BOLT_BUCKET_SET     = []byte("set")
+    BOLT_BUCKET_ZSET    = []byte("zset")
+    BOLT_BUCKET_ZSCORE  = []byte("zscore")
+    BOLT_BUCKET_COUNTER = []byte("counter")
+)
+
+// BoltStore keeps all data in a single local file. A zset is kept twice:
+// zset/<key> maps members to scores and zscore/<key> holds score+member
+// keys in score order for range queries. Expired hashes are removed when
+// they are next accessed, like Redis does.
+type BoltStore struct {
+    *bolt.DB
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+    db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: DEFAULT_BOLT_TIMEOUT * time.Second})
+    if err != nil {
+        return nil, fmt.Errorf("open %s: %s", path, err.Error())
+    }
+    err = db.Update(func(tx *bolt.Tx) error {
+        for _, name := range [][]byte{BOLT_BUCKET_HASH, BOLT_BUCKET_EXPIRE, BOLT_BUCKET_SET, BOLT_BUCKET_ZSET, BOLT_BUCKET_ZSCORE, BOLT_BUCKET_COUNTER} {
+            if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        db.Close()
+        return nil, err
+    }
+    return &BoltStore{db}, nil
+}
+
+func (s *BoltStore) Ping() error {
+    return s.View(func(tx *bolt.Tx) error {
+        return nil
+    })
+}
+
+// encodeScore turns a score into 8 bytes that sort like the float.
+func encodeScore(score float64) []byte {
+    bits := math.Float64bits(score)
+    if score >= 0 {
+        bits ^= 1 << 63
+    } else {
+        bits = ^bits
+    }
+    result := make([]byte, 8)
+    binary.BigEndian.PutUint64(result, bits)
+    return result
+}
+
+func decodeScore(b []byte) float64 {
+    bits := binary.BigEndian.Uint64(b[:8])
+    if bits & (1 << 63) != 0 {
+        bits ^= 1 << 63
+    } else {
+        bits = ^bits
+    }
+    return math.Float64frombits(bits)
+}
+
+func boltBucket(tx *bolt.Tx, name []byte, key string) *bolt.Bucket {
+    return tx.Bucket(name).Bucket([]byte(key))
+}
+
+func boltCreateBucket(tx *bolt.Tx, name []byte, key string) (*bolt.Bucket, error) {
+    return tx.Bucket(name).CreateBucketIfNotExists([]byte(key))
+}
+
+func boltDeleteBucket(tx *bolt.Tx, name []byte, key string) {
+    if tx.Bucket(name).Bucket([]byte(key)) != nil {
+        tx.Bucket(name).DeleteBucket([]byte(key))
+    }
+}
+
+func isBucketEmpty(b *bolt.Bucket) bool {
+    k, _ := b.Cursor().First()
+    return k == nil
+}
+
+func isExpired(tx *bolt.Tx, key string) bool {
+    v := tx.Bucket(BOLT_BUCKET_EXPIRE).Get([]byte(key))
+    if v == nil {
+        return false
+    }
+    t, _ := strconv.ParseInt(string(v), 10, 64)
+    return time.Now().Unix() >= t
+}
+
+// hash returns the live hash bucket of key, nil when missing or expired.
+func hash(tx *bolt.Tx, key string) *bolt.Bucket {
+    if isExpired(tx, key) {
+        return nil
+    }
+    return boltBucket(tx, BOLT_BUCKET_HASH, key)
+}
+
+func hashFields(b *bolt.Bucket) map[string]string {
+    result := make(map[string]string)
+    if b == nil {
+        return result
+    }
+    b.ForEach(func(k, v []byte) error {
+        result[string(k)] = string(v)
+        return nil
+    })
+    return result
+}
+
+func setHashFields(tx *bolt.Tx, key string, fields map[string]string) error {
+    b, err := boltCreateBucket(tx, BOLT_BUCKET_HASH, key)
+    if err != nil {
+        return err
+    }
+    for k, v := range fields {
+        if err := b.Put([]byte(k), []byte(v)); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func deleteHash(tx *bolt.Tx, key string) {
+    boltDeleteBucket(tx, BOLT_BUCKET_HASH, key)
+    tx.Bucket(BOLT_BUCKET_EXPIRE).Delete([]byte(key))
+}
+
+// purge removes key once it has expired.
+func (s *BoltStore) purge(key string) {
+    s.Update(func(tx *bolt.Tx) error {
+        if isExpired(tx, key) {
+            deleteHash(tx, key)
+        }
+        return nil
+    })
+}
+
+func zadd(tx *bolt.Tx, key string, member string, score float64) error {
+    zb, err := boltCreateBucket(tx, BOLT_BUCKET_ZSET, key)
+    if err != nil {
+        return err
+    }
+    sb, err := boltCreateBucket(tx, BOLT_BUCKET_ZSCORE, key)
+    if err != nil {
+        return err
+    }
+    if old := zb.Get([]byte(member)); old != nil {
+        sb.Delete(append(append([]byte{}, old...), member...))
+    }
+    encoded := encodeScore(score)
+    if err := zb.Put([]byte(member), encoded); err != nil {
+        return err
+    }
+    return sb.Put(append(encoded, member...), []byte{})
+}
+
+func zscore(tx *bolt.Tx, key string, member string) (float64, bool) {
+    zb := boltBucket(tx, BOLT_BUCKET_ZSET, key)
+    if zb == nil {
+        return 0, false
+    }
+    v := zb.Get([]byte(member))
+    if v == nil {
+        return 0, false
+    }
+    return decodeScore(v), true
+}
+
+func zrem(tx *bolt.Tx, key string, member string) {
+    zb := boltBucket(tx, BOLT_BUCKET_ZSET, key)
+    if zb == nil {
+        return
+    }
+    if old := zb.Get([]byte(member)); old != nil {
+        boltBucket(tx, BOLT_BUCKET_ZSCORE, key).Delete(append(append([]byte{}, old...), member...))
+        zb.Delete([]byte(member))
+    }
+    if isBucketEmpty(zb) {
+        zdel(tx, key)
+    }
+}
+
+func zdel(tx *bolt.Tx, key string) {
+    boltDeleteBucket(tx, BOLT_BUCKET_ZSET, key)
+    boltDeleteBucket(tx, BOLT_BUCKET_ZSCORE, key)
+}
+
+func zmembers(tx *bolt.Tx, key string) map[string]float64 {
+    result := make(map[string]float64)
+    if zb := boltBucket(tx, BOLT_BUCKET_ZSET, key); zb != nil {
+        zb.ForEach(func(k, v []byte) error {
+            result[string(k)] = decodeScore(v)
+            return nil
+        })
+    }
+    return result
+}
+
+func zstore(tx *bolt.Tx, key string, members map[string]float64) error {
+    zdel(tx, key)
+    for member, score := range members {
+        if err := zadd(tx, key, member, score); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// zrevrange walks a zset from the highest score down and calls fn until it
+// returns false.
+func zrevrange(tx *bolt.Tx, key string, max float64, fn func(member string, score float64) bool) {
+    sb := boltBucket(tx, BOLT_BUCKET_ZSCORE, key)
+    if sb == nil {
+        return
+    }
+    c := sb.Cursor()
+    var k []byte
+    if math.IsInf(max, 1) || math.IsNaN(max) {
+        k, _ = c.Last()
+    } else if k, _ = c.Seek(encodeScore(math.Nextafter(max, math.Inf(1)))); k == nil {
+        k, _ = c.Last()
+    } else {
+        k, _ = c.Prev()
+    }
+    for ; k != nil; k, _ = c.Prev() {
+        if !fn(string(k[8:]), decodeScore(k)) {
+            return
+        }
+    }
+}
+
+func sadd(tx *bolt.Tx, key string, member string) error {
+    b, err := boltCreateBucket(tx, BOLT_BUCKET_SET, key)
+    if err != nil {
+        return err
+    }
+    return b.Put([]byte(member), []byte{})
+}
+
+func srem(tx *bolt.Tx, key string, member string) {
+    if b := boltBucket(tx, BOLT_BUCKET_SET, key); b != nil {
+        b.Delete([]byte(member))
+    }
+}
+
+func smembers(tx *bolt.Tx, key string) []string {
+    var result []string
+    if b := boltBucket(tx, BOLT_BUCKET_SET, key); b != nil {
+        b.ForEach(func(k, v []byte) error {
+            result = append(result, string(k))
+            return nil
+        })
+    }
+    return result
+}
+
+func getCounter(tx *bolt.Tx, key string) int {
+    v, _ := strconv.Atoi(string(tx.Bucket(BOLT_BUCKET_COUNTER).Get([]byte(key))))
+    return v
+}
+
+func setCounter(tx *bolt.Tx, key string, n int) error {
+    return tx.Bucket(BOLT_BUCKET_COUNTER).Put([]byte(key), []byte(strconv.Itoa(n)))
+}
+
+// prefixKeys returns the nested bucket names under name starting with
+// prefix.
+func prefixKeys(tx *bolt.Tx, name []byte, prefix string) []string {
+    var result []string
+    c := tx.Bucket(name).Cursor()
+    for k, _ := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = c.Next() {
+        result = append(result, string(k))
+    }
+    return result
+}
+
+// getOtherDicts returns the dictionaries other than dict whose dict:words
+// set lists word, in name order.
+func getOtherDicts(tx *bolt.Tx, dict string, word string) []string {
+    var result []string
+    for _, key := range prefixKeys(tx, BOLT_BUCKET_SET, REDISKEY_DICT_WORDS_PREFIX) {
+        if b := boltBucket(tx, BOLT_BUCKET_SET, key); key != REDISKEY_DICT_WORDS_PREFIX + dict && b != nil && b.Get([]byte(word)) != nil {
+            result = append(result, strings.TrimPrefix(key, REDISKEY_DICT_WORDS_PREFIX))
+        }
+    }
+    return result
+}
+
+func (s *BoltStore) AddItem(item ItemRedis, links []string, score float64, expire time.Time, indexes []string) (int, error) {
+    id := 0
+    err := s.Update(func(tx *bolt.Tx) error {
+        if tx.Bucket(BOLT_BUCKET_COUNTER).Get([]byte(REDISKEY_FEED_ID)) == nil {
+            setCounter(tx, REDISKEY_FEED_ID, len(smembers(tx, REDISKEY_FEED_EXISTS)))
+        }
+        var keyname string
+        for {
+            id = getCounter(tx, REDISKEY_FEED_ID) + 1
+            setCounter(tx, REDISKEY_FEED_ID, id)
+            keyname = REDISKEY_FEED_ITEM_PREFIX + strconv.Itoa(id)
+            if isExpired(tx, keyname) {
+                deleteHash(tx, keyname)
+            }
+            if boltBucket(tx, BOLT_BUCKET_HASH, keyname) == nil {
+                break
+            }
+        }
+        item.Id = id
+        for _, link := range links {
+            if err := sadd(tx, REDISKEY_FEED_EXISTS, link); err != nil {
+                return err
+            }
+        }
+        if err := setHashFields(tx, REDISKEY_FEED_LINKS, map[string]string{keyname: JoinItemLinks(links)}); err != nil {
+            return err
+        }
+        for _, index := range indexes {
+            if err := zadd(tx, index, keyname, score); err != nil {
+                return err
+            }
+        }
+        if err := setHashFields(tx, keyname, flattenFields(item)); err != nil {
+            return err
+        }
+        return tx.Bucket(BOLT_BUCKET_EXPIRE).Put([]byte(keyname), []byte(strconv.FormatInt(expire.Unix(), 10)))
+    })
+    return id, err
+}
+
+func (s *BoltStore) GetItem(keyname string) (ItemRedis, bool) {
+    item := ItemRedis{}
+    found, expired := false, false
+    s.View(func(tx *bolt.Tx) error {
+        expired = isExpired(tx, keyname)
+        if b := hash(tx, keyname); b != nil {
+            scanFields(hashFields(b), &item)
+            found = true
+        }
+        return nil
+    })
+    if expired {
+        s.purge(keyname)
+    }
+    return item, found
+}
+
+func (s *BoltStore) GetItemKeys() []string {
+    var result []string
+    s.View(func(tx *bolt.Tx) error {
+        for _, key := range prefixKeys(tx, BOLT_BUCKET_HASH, REDISKEY_FEED_ITEM_PREFIX) {
+            if !isExpired(tx, key) {
+                result = append(result, key)
+            }
+        }
+        return nil
+    })
+    return result
+}
+
+func (s *BoltStore) GetItemsField(keynames []string, field string) []string {
+    result := make([]string, len(keynames))
+    s.View(func(tx *bolt.Tx) error {
+        for i, keyname := range keynames {
+            if b := hash(tx, keyname); b != nil {
+                result[i] = string(b.Get([]byte(field)))
+            }
+        }
+        return nil
+    })
+    return result
+}
+
+func (s *BoltStore) SetItemField(keyname string, field string, value interface{}) error {
+    return s.Update(func(tx *bolt.Tx) error {
+        return setHashFields(tx, keyname, map[string]string{field: fmt.Sprint(value)})
+    })
+}
+
+func (s *BoltStore) IncrItemField(keyname string, field string, n int) error {
+    return s.Update(func(tx *bolt.Tx) error {
+        v := 0
+        if b := hash(tx, keyname); b != nil {
+            v, _ = strconv.Atoi(string(b.Get([]byte(field))))
+        }
+        return setHashFields(tx, keyname, map[string]string{field: strconv.Itoa(v + n)})
+    })
+}
+
+func (s *BoltStore) IsKeyExists(keyname string) bool {
+    result, expired := false, false
+    s.View(func(tx *bolt.Tx) error {
+        expired = isExpired(tx, keyname)
+        result = hash(tx, keyname) != nil ||
+            boltBucket(tx, BOLT_BUCKET_ZSET, keyname) != nil ||
+            boltBucket(tx, BOLT_BUCKET_SET, keyname) != nil ||
+            tx.Bucket(BOLT_BUCKET_COUNTER).Get([]byte(keyname)) != nil
+        return nil
+    })
+    if expired {
+        s.purge(keyname)
+    }
+    return result
+}
+
+func (s *BoltStore) IsItemExists(link string) bool {
+    result := false
+    s.View(func(tx *bolt.Tx) error {
+        if b := boltBucket(tx, BOLT_BUCKET_SET, REDISKEY_FEED_EXISTS); b != nil {
+            result = b.Get([]byte(link)) != nil
+        }
+        return nil
+    })
+    return result
+}
+
+func (s *BoltStore) GetItemLinks() []string {
+    var result []string
+    s.View(func(tx *bolt.Tx) error {
+        result = smembers(tx, REDISKEY_FEED_EXISTS)
+        return nil
+    })
+    return result
+}
+
+func (s *BoltStore) GetItemLink(keyname string) []string {
+    var result []string
+    s.View(func(tx *bolt.Tx) error {
+        if b := hash(tx, REDISKEY_FEED_LINKS); b != nil {
+            result = SplitItemLinks(string(b.Get([]byte(keyname))))
+        }
+        return nil
+    })
+    return result
+}
+
+func (s *BoltStore) SetItemLink(keyname string, links []string) error {
+    return s.Update(func(tx *bolt.Tx) error {
+        return setHashFields(tx, REDISKEY_FEED_LINKS, map[string]string{keyname: JoinItemLinks(links)})
+    })
+}
+
+func (s *BoltStore) RemoveItemLink(keyname string, links []string) error {
+    return s.Update(func(tx *bolt.Tx) error {
+        for _, link := range links {
+            srem(tx, REDISKEY_FEED_EXISTS, link)
+        }
+        if b := hash(tx, REDISKEY_FEED_LINKS); b != nil {
+            return b.Delete([]byte(keyname))
+        }
+        return nil
+    })
+}
+
+func (s *BoltStore) RemoveLinks(links ...string) error {
+    return s.Update(func(tx *bolt.Tx) error {
+        for _, link := range links {
+            srem(tx, REDISKEY_FEED_EXISTS, link)
+        }
+        return nil
+    })
+}
+
+func (s *BoltStore) GetChannelState(url string) ChannelState {
+    state := ChannelState{}
+    s.View(func(tx *bolt.Tx) error {
+        scanFields(hashFields(hash(tx, GetChannelKeyname(url))), &state)
+        return nil
+    })
+    return state
+}
+
+func (s *BoltStore) SetChannelState(state ChannelState) error {
+    return s.Update(func(tx *bolt.Tx) error {
+        return setHashFields(tx, GetChannelKeyname(state.Url), flattenFields(state))
+    })
+}
+
+func (s *BoltStore) AddIndex(index string, score float64, keyname string) error {
+    return s.Update(func(tx *bolt.Tx) error {
+        return zadd(tx, index, keyname, score)
+    })
+}
+
+func (s *BoltStore) RemoveIndex(keyname string, indexes ...string) error {
+    return s.Update(func(tx *bolt.Tx) error {
+        for _, index := range indexes {
+            zrem(tx, index, keyname)
+        }
+        return nil
+    })
+}
+
+func (s *BoltStore) GetIndexScore(index string, keyname string) (float64, bool) {
+    var score float64
+    ok := false
+    s.View(func(tx *bolt.Tx) error {
+        score, ok = zscore(tx, index, keyname)
+        return nil
+    })
+    return score, ok
+}
+
+func (s *BoltStore) GetIndexRange(index string, min float64, max float64, offset int, count int) []string {
+    var result []string
+    s.View(func(tx *bolt.Tx) error {
+        zrevrange(tx, index, max, func(member string, score float64) bool {
+            if score < min || (count >= 0 && len(result) >= count) {
+                return false
+            }
+            if offset > 0 {
+                offset--
+                return true
+            }
+            result = append(result, member)
+            return true
+        })
+        return nil
+    })
+    return result
+}
+
+func (s *BoltStore) IncrRank(rankkey string, keyname string, n float64) error {
+    return s.Update(func(tx *bolt.Tx) error {
+        score, _ := zscore(tx, rankkey, keyname)
+        return zadd(tx, rankkey, keyname, score + n)
+    })
+}
+
+func (s *BoltStore) UnionRank(dest string, rankkeys []string, weights []float64) error {
+    return s.Update(func(tx *bolt.Tx) error {
+        result := make(map[string]float64)
+        for i, rankkey := range rankkeys {
+            weight := 1.0
+            if weights != nil {
+                weight = weights[i]
+            }
+            for member, score := range zmembers(tx, rankkey) {
+                result[member] += score * weight
+            }
+        }
+        return zstore(tx, dest, result)
+    })
+}
+
+func (s *BoltStore) FilterRank(dest string, rankkey string, index string) error {
+    return s.Update(func(tx *bolt.Tx) error {
+        result := make(map[string]float64)
+        for member, score := range zmembers(tx, rankkey) {
+            if _, ok := zscore(tx, index, member); ok {
+                result[member] = score
+            }
+        }
+        return zstore(tx, dest, result)
+    })
+}
+
+func (s *BoltStore) GetRankRange(rankkey string, start int, stop int) []string {
+    var result []string
+    s.View(func(tx *bolt.Tx) error {
+        var members []string
+        zrevrange(tx, rankkey, math.Inf(1), func(member string, score float64) bool {
+            members = append(members, member)
+            return true
+        })
+        start, stop = getRangeBounds(len(members), start, stop)
+        for i := start; i <= stop; i++ {
+            result = append(result, members[i])
+        }
+        return nil
+    })
+    return result
+}
+
+func (s *BoltStore) GetRankScore(rankkey string, keyname string) (float64, bool) {
+    return s.GetIndexScore(rankkey, keyname)
+}
+
+func (s *BoltStore) GetRankScores(rankkey string) map[string]float64 {
+    var result map[string]float64
+    s.View(func(tx *bolt.Tx) error {
+        result = zmembers(tx, rankkey)
+        return nil
+    })
+    return result
+}
+
+func (s *BoltStore) SetRank(rankkey string, scores map[string]float64) error {
+    return s.Update(func(tx *bolt.Tx) error {
+        return zstore(tx, rankkey, scores)
+    })
+}
+
+func (s *BoltStore) GetRankKeys() []string {
+    var result []string
+    s.View(func(tx *bolt.Tx) error {
+        result = prefixKeys(tx, BOLT_BUCKET_ZSET, REDISKEY_FEED_RANK_PREFIX)
+        return nil
+    })
+    return result
+}
+
+func (s *BoltStore) RemoveRank(keyname string, rankkeys ...string) error {
+    return s.RemoveIndex(keyname, rankkeys...)
+}
+
+func (s *BoltStore) DeleteRank(rankkeys ...string) error {
+    return s.Update(func(tx *bolt.Tx) error {
+        for _, rankkey := range rankkeys {
+            zdel(tx, rankkey)
+        }
+        return nil
+    })
+}
+
+func (s *BoltStore) AddDictItem(word string, item DictItemRedis) error {
+    return s.Update(func(tx *bolt.Tx) error {
+        if err := sadd(tx, REDISKEY_DICT_WORDS_PREFIX + item.Dict, word); err != nil {
+            return err
+        }
+        if err := setHashFields(tx, GetDictEntryKeyname(item.Dict, word), flattenFields(item)); err != nil {
+            return err
+        }
+        if len(getOtherDicts(tx, item.Dict, word)) > 0 {
+            return nil
+        }
+        if err := sadd(tx, REDISKEY_DICT_EXISTS, word); err != nil {
+            return err
+        }
+        return setHashFields(tx, REDISKEY_DICT_ITEM_PREFIX + word, flattenFields(item))
+    })
+}
+
+func (s *BoltStore) ReplaceDictItems(dict string, items map[string]DictItemRedis) error {
+    return s.Update(func(tx *bolt.Tx) error {
+        for _, word := range smembers(tx, REDISKEY_DICT_WORDS_PREFIX + dict) {
+            if _, ok := items[word]; ok {
+                continue
+            }
+            deleteHash(tx, GetDictEntryKeyname(dict, word))
+            others := getOtherDicts(tx, dict, word)
+            if len(others) == 0 {
+                srem(tx, REDISKEY_DICT_EXISTS, word)
+                deleteHash(tx, REDISKEY_DICT_ITEM_PREFIX + word)
+                continue
+            }
+            for _, other := range others {
+                if entry := hash(tx, GetDictEntryKeyname(other, word)); entry != nil {
+                    fields := hashFields(entry)
+                    deleteHash(tx, REDISKEY_DICT_ITEM_PREFIX + word)
+                    if err := setHashFields(tx, REDISKEY_DICT_ITEM_PREFIX + word, fields); err != nil {
+                        return err
+                    }
+                    break
+                }
+            }
+        }
+        boltDeleteBucket(tx, BOLT_BUCKET_SET, REDISKEY_DICT_WORDS_PREFIX + dict)
+        for word, item := range items {
+            if err := sadd(tx, REDISKEY_DICT_WORDS_PREFIX + dict, word); err != nil {
+                return err
+            }
+            deleteHash(tx, GetDictEntryKeyname(dict, word))
+            if err := setHashFields(tx, GetDictEntryKeyname(dict, word), flattenFields(item)); err != nil {
+                return err
+            }
+            if len(getOtherDicts(tx, dict, word)) > 0 {
+                continue
+            }
+            if err := sadd(tx, REDISKEY_DICT_EXISTS, word); err != nil {
+                return err
+            }
+            deleteHash(tx, REDISKEY_DICT_ITEM_PREFIX + word)
+            if err := setHashFields(tx, REDISKEY_DICT_ITEM_PREFIX + word, flattenFields(item)); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+}
+
+func (s *BoltStore) GetDictWords() []string {
+    var result []string
+    s.View(func(tx *bolt.Tx) error {
+        result = smembers(tx, REDISKEY_DICT_EXISTS)
+        return nil
+    })
+    return result
+}
+
+func (s *BoltStore) GetDictItem(word string) DictItemRedis {
+    item := DictItemRedis{}
+    s.View(func(tx *bolt.Tx) error {
+        scanFields(hashFields(hash(tx, REDISKEY_DICT_ITEM_PREFIX + word)), &item)
+        return nil
+    })
+    return item
+}
+
+// AddVisitor keeps the visitors in a set; expired visitor sets are swept
+// whenever a new one is created.
+func (s *BoltStore) AddVisitor(key string, visitor string, expire time.Time) (bool, error) {
+    added := false
+    err := s.Update(func(tx *bolt.Tx) error {
+        b := boltBucket(tx, BOLT_BUCKET_SET, key)
+        if b == nil {
+            for _, k := range prefixKeys(tx, BOLT_BUCKET_SET, REDISKEY_FEED_VISITOR_PREFIX) {
+                if isExpired(tx, k) {
+                    boltDeleteBucket(tx, BOLT_BUCKET_SET, k)
+                    tx.Bucket(BOLT_BUCKET_EXPIRE).Delete([]byte(k))
+                }
+            }
+        }
+        if b != nil && b.Get([]byte(visitor)) != nil {
+            return nil
+        }
+        added = true
+        if err := sadd(tx, key, visitor); err != nil {
+            return err
+        }
+        return tx.Bucket(BOLT_BUCKET_EXPIRE).Put([]byte(key), []byte(strconv.FormatInt(expire.Unix(), 10)))
+    })
+    return added, err
+}
+
+func (s *BoltStore) AddSearchItem(keyname string, tokens []string, score float64) error {
+    return s.Update(func(tx *bolt.Tx) error {
+        for _, token := range tokens {
+            if err := zadd(tx, REDISKEY_SEARCH_TOKEN_PREFIX + token, keyname, score); err != nil {
+                return err
+            }
+            if err := sadd(tx, REDISKEY_SEARCH_ITEM_PREFIX + keyname, token); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+}
+
+func (s *BoltStore) RemoveSearchItem(keyname string) error {
+    return s.Update(func(tx *bolt.Tx) error {
+        for _, token := range smembers(tx, REDISKEY_SEARCH_ITEM_PREFIX + keyname) {
+            zrem(tx, REDISKEY_SEARCH_TOKEN_PREFIX + token, keyname)
+        }
+        boltDeleteBucket(tx, BOLT_BUCKET_SET, REDISKEY_SEARCH_ITEM_PREFIX + keyname)
+        return nil
+    })
+}
+
+func (s *BoltStore) SearchItems(indexes []string, min float64, max float64, offset int, count int) []string {
+    var result []string
+    s.View(func(tx *bolt.Tx) error {
+        var zsets []map[string]float64
+        for _, index := range indexes {
+            zsets = append(zsets, zmembers(tx, index))
+        }
+        result = getScoreRange(interZsets(zsets), min, max, offset, count)
+        return nil
+    })
+    return result
+}
+
+func (s *BoltStore) IncrCounter(key string, n int) (int, error) {
+    result := 0
+    err := s.Update(func(tx *bolt.Tx) error {
+        result = getCounter(tx, key) + n
+        return setCounter(tx, key, result)
+    })
+    return result, err
+}
+
+func (s *BoltStore) GetCounter(key string) int {
+    result := 0
+    s.View(func(tx *bolt.Tx) error {
+        result = getCounter(tx, key)
+        return nil
+    })
+    return result
+}
+
+func (s *BoltStore) SetCounter(key string, n int) error {
+    return s.Update(func(tx *bolt.Tx) error {
+        return setCounter(tx, key, n)
+    })
+}
+
+func (s *BoltStore) DeleteCounter(keys ...string) error {
+    return s.Update(func(tx *bolt.Tx) error {
+        for _, key := range keys {
+            tx.Bucket(BOLT_BUCKET_COUNTER).Delete([]byte(key))
+        }
+        return nil
+    })
+}
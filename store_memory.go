@@ -0,0 +1,620 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// MemoryStore keeps everything in process memory. Nothing survives a
+// restart, which makes it suitable for trying colle out and for tests.
+type MemoryStore struct {
+    mu       sync.Mutex
+    hashes   map[string]map[string]string
+    expires  map[string]time.Time
+    sets     map[string]map[string]bool
+    zsets    map[string]map[string]float64
+    counters map[string]int
+}
+
+type scoredMember struct {
+    Member string
+    Score  float64
+}
+
+func NewMemoryStore() *MemoryStore {
+    return &MemoryStore{
+        hashes:   make(map[string]map[string]string),
+        expires:  make(map[string]time.Time),
+        sets:     make(map[string]map[string]bool),
+        zsets:    make(map[string]map[string]float64),
+        counters: make(map[string]int),
+    }
+}
+
+func (s *MemoryStore) Ping() error {
+    return nil
+}
+
+func (s *MemoryStore) Close() error {
+    return nil
+}
+
+// hash returns the fields of key, dropping the key once it has expired.
+func (s *MemoryStore) hash(key string, create bool) map[string]string {
+    if t, ok := s.expires[key]; ok && !time.Now().Before(t) {
+        delete(s.hashes, key)
+        delete(s.expires, key)
+    }
+    h, ok := s.hashes[key]
+    if !ok && create {
+        h = make(map[string]string)
+        s.hashes[key] = h
+    }
+    return h
+}
+
+func (s *MemoryStore) set(key string) map[string]bool {
+    v, ok := s.sets[key]
+    if !ok {
+        v = make(map[string]bool)
+        s.sets[key] = v
+    }
+    return v
+}
+
+func (s *MemoryStore) zset(key string) map[string]float64 {
+    v, ok := s.zsets[key]
+    if !ok {
+        v = make(map[string]float64)
+        s.zsets[key] = v
+    }
+    return v
+}
+
+// sortedMembers returns the members of a zset, highest score first and
+// ties in reverse lexical order like ZREVRANGE.
+func (s *MemoryStore) sortedMembers(key string) []scoredMember {
+    var result []scoredMember
+    for member, score := range s.zsets[key] {
+        result = append(result, scoredMember{member, score})
+    }
+    sort.Sort(byScoreDesc(result))
+    return result
+}
+
+type byScoreDesc []scoredMember
+
+func (a byScoreDesc) Len() int      { return len(a) }
+func (a byScoreDesc) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byScoreDesc) Less(i, j int) bool {
+    if a[i].Score != a[j].Score {
+        return a[i].Score > a[j].Score
+    }
+    return a[i].Member > a[j].Member
+}
+
+func (s *MemoryStore) AddItem(item ItemRedis, links []string, score float64, expire time.Time, indexes []string) (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, ok := s.counters[REDISKEY_FEED_ID]; !ok {
+        s.counters[REDISKEY_FEED_ID] = len(s.sets[REDISKEY_FEED_EXISTS])
+    }
+    var keyname string
+    for {
+        s.counters[REDISKEY_FEED_ID]++
+        keyname = REDISKEY_FEED_ITEM_PREFIX + strconv.Itoa(s.counters[REDISKEY_FEED_ID])
+        if s.hash(keyname, false) == nil {
+            break
+        }
+    }
+    item.Id = s.counters[REDISKEY_FEED_ID]
+    for _, link := range links {
+        s.set(REDISKEY_FEED_EXISTS)[link] = true
+    }
+    s.hash(REDISKEY_FEED_LINKS, true)[keyname] = JoinItemLinks(links)
+    for _, index := range indexes {
+        s.zset(index)[keyname] = score
+    }
+    s.hashes[keyname] = flattenFields(item)
+    s.expires[keyname] = expire
+    return item.Id, nil
+}
+
+func (s *MemoryStore) GetItem(keyname string) (ItemRedis, bool) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    item := ItemRedis{}
+    h := s.hash(keyname, false)
+    if h == nil {
+        return item, false
+    }
+    scanFields(h, &item)
+    return item, true
+}
+
+func (s *MemoryStore) GetItemKeys() []string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var result []string
+    for key := range s.hashes {
+        if strings.HasPrefix(key, REDISKEY_FEED_ITEM_PREFIX) && s.hash(key, false) != nil {
+            result = append(result, key)
+        }
+    }
+    return result
+}
+
+func (s *MemoryStore) GetItemsField(keynames []string, field string) []string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    result := make([]string, len(keynames))
+    for i, keyname := range keynames {
+        result[i] = s.hash(keyname, false)[field]
+    }
+    return result
+}
+
+func (s *MemoryStore) SetItemField(keyname string, field string, value interface{}) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.hash(keyname, true)[field] = fmt.Sprint(value)
+    return nil
+}
+
+func (s *MemoryStore) IncrItemField(keyname string, field string, n int) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    h := s.hash(keyname, true)
+    v, _ := strconv.Atoi(h[field])
+    h[field] = strconv.Itoa(v + n)
+    return nil
+}
+
+func (s *MemoryStore) IsKeyExists(keyname string) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.hash(keyname, false) != nil || s.zsets[keyname] != nil || s.sets[keyname] != nil
+}
+
+func (s *MemoryStore) IsItemExists(link string) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.sets[REDISKEY_FEED_EXISTS][link]
+}
+
+func (s *MemoryStore) GetItemLinks() []string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var result []string
+    for link := range s.sets[REDISKEY_FEED_EXISTS] {
+        result = append(result, link)
+    }
+    return result
+}
+
+func (s *MemoryStore) GetItemLink(keyname string) []string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return SplitItemLinks(s.hash(REDISKEY_FEED_LINKS, false)[keyname])
+}
+
+func (s *MemoryStore) SetItemLink(keyname string, links []string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.hash(REDISKEY_FEED_LINKS, true)[keyname] = JoinItemLinks(links)
+    return nil
+}
+
+func (s *MemoryStore) RemoveItemLink(keyname string, links []string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, link := range links {
+        delete(s.set(REDISKEY_FEED_EXISTS), link)
+    }
+    delete(s.hash(REDISKEY_FEED_LINKS, true), keyname)
+    return nil
+}
+
+func (s *MemoryStore) RemoveLinks(links ...string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, link := range links {
+        delete(s.set(REDISKEY_FEED_EXISTS), link)
+    }
+    return nil
+}
+
+func (s *MemoryStore) GetChannelState(url string) ChannelState {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    state := ChannelState{}
+    scanFields(s.hash(GetChannelKeyname(url), false), &state)
+    return state
+}
+
+func (s *MemoryStore) SetChannelState(state ChannelState) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    h := s.hash(GetChannelKeyname(state.Url), true)
+    for k, v := range flattenFields(state) {
+        h[k] = v
+    }
+    return nil
+}
+
+func (s *MemoryStore) AddIndex(index string, score float64, keyname string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.zset(index)[keyname] = score
+    return nil
+}
+
+func (s *MemoryStore) RemoveIndex(keyname string, indexes ...string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, index := range indexes {
+        if z, ok := s.zsets[index]; ok {
+            delete(z, keyname)
+            if len(z) == 0 {
+                delete(s.zsets, index)
+            }
+        }
+    }
+    return nil
+}
+
+func (s *MemoryStore) GetIndexScore(index string, keyname string) (float64, bool) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    score, ok := s.zsets[index][keyname]
+    return score, ok
+}
+
+func (s *MemoryStore) GetIndexRange(index string, min float64, max float64, offset int, count int) []string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return getScoreRange(s.sortedMembers(index), min, max, offset, count)
+}
+
+func (s *MemoryStore) IncrRank(rankkey string, keyname string, n float64) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.zset(rankkey)[keyname] += n
+    return nil
+}
+
+func (s *MemoryStore) UnionRank(dest string, rankkeys []string, weights []float64) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    result := make(map[string]float64)
+    for i, rankkey := range rankkeys {
+        weight := 1.0
+        if weights != nil {
+            weight = weights[i]
+        }
+        for member, score := range s.zsets[rankkey] {
+            result[member] += score * weight
+        }
+    }
+    s.storeZset(dest, result)
+    return nil
+}
+
+func (s *MemoryStore) FilterRank(dest string, rankkey string, index string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    result := make(map[string]float64)
+    members := s.zsets[index]
+    for member, score := range s.zsets[rankkey] {
+        if _, ok := members[member]; ok {
+            result[member] = score
+        }
+    }
+    s.storeZset(dest, result)
+    return nil
+}
+
+func (s *MemoryStore) storeZset(key string, z map[string]float64) {
+    if len(z) == 0 {
+        delete(s.zsets, key)
+        return
+    }
+    s.zsets[key] = z
+}
+
+func (s *MemoryStore) GetRankRange(rankkey string, start int, stop int) []string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    members := s.sortedMembers(rankkey)
+    start, stop = getRangeBounds(len(members), start, stop)
+    var result []string
+    for i := start; i <= stop; i++ {
+        result = append(result, members[i].Member)
+    }
+    return result
+}
+
+func (s *MemoryStore) GetRankScore(rankkey string, keyname string) (float64, bool) {
+    return s.GetIndexScore(rankkey, keyname)
+}
+
+func (s *MemoryStore) GetRankScores(rankkey string) map[string]float64 {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    result := make(map[string]float64)
+    for member, score := range s.zsets[rankkey] {
+        result[member] = score
+    }
+    return result
+}
+
+func (s *MemoryStore) SetRank(rankkey string, scores map[string]float64) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    z := make(map[string]float64)
+    for member, score := range scores {
+        z[member] = score
+    }
+    s.storeZset(rankkey, z)
+    return nil
+}
+
+func (s *MemoryStore) GetRankKeys() []string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var result []string
+    for key := range s.zsets {
+        if strings.HasPrefix(key, REDISKEY_FEED_RANK_PREFIX) {
+            result = append(result, key)
+        }
+    }
+    return result
+}
+
+func (s *MemoryStore) RemoveRank(keyname string, rankkeys ...string) error {
+    return s.RemoveIndex(keyname, rankkeys...)
+}
+
+func (s *MemoryStore) DeleteRank(rankkeys ...string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, rankkey := range rankkeys {
+        delete(s.zsets, rankkey)
+    }
+    return nil
+}
+
+func (s *MemoryStore) AddDictItem(word string, item DictItemRedis) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.set(REDISKEY_DICT_WORDS_PREFIX + item.Dict)[word] = true
+    s.hashes[GetDictEntryKeyname(item.Dict, word)] = flattenFields(item)
+    if len(s.getOtherDicts(item.Dict, word)) > 0 {
+        return nil
+    }
+    s.set(REDISKEY_DICT_EXISTS)[word] = true
+    s.hashes[REDISKEY_DICT_ITEM_PREFIX + word] = flattenFields(item)
+    return nil
+}
+
+func (s *MemoryStore) ReplaceDictItems(dict string, items map[string]DictItemRedis) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for word := range s.sets[REDISKEY_DICT_WORDS_PREFIX + dict] {
+        if _, ok := items[word]; ok {
+            continue
+        }
+        delete(s.hashes, GetDictEntryKeyname(dict, word))
+        others := s.getOtherDicts(dict, word)
+        if len(others) == 0 {
+            delete(s.set(REDISKEY_DICT_EXISTS), word)
+            delete(s.hashes, REDISKEY_DICT_ITEM_PREFIX + word)
+            continue
+        }
+        for _, other := range others {
+            if entry := s.hash(GetDictEntryKeyname(other, word), false); entry != nil {
+                item := make(map[string]string)
+                for k, v := range entry {
+                    item[k] = v
+                }
+                s.hashes[REDISKEY_DICT_ITEM_PREFIX + word] = item
+                break
+            }
+        }
+    }
+    words := make(map[string]bool)
+    for word, item := range items {
+        words[word] = true
+        s.hashes[GetDictEntryKeyname(dict, word)] = flattenFields(item)
+        if len(s.getOtherDicts(dict, word)) > 0 {
+            continue
+        }
+        s.set(REDISKEY_DICT_EXISTS)[word] = true
+        s.hashes[REDISKEY_DICT_ITEM_PREFIX + word] = flattenFields(item)
+    }
+    s.sets[REDISKEY_DICT_WORDS_PREFIX + dict] = words
+    return nil
+}
+
+// getOtherDicts returns the dictionaries other than dict whose dict:words
+// set lists word, in name order.
+func (s *MemoryStore) getOtherDicts(dict string, word string) []string {
+    var result []string
+    for key, members := range s.sets {
+        if strings.HasPrefix(key, REDISKEY_DICT_WORDS_PREFIX) && key != REDISKEY_DICT_WORDS_PREFIX + dict && members[word] {
+            result = append(result, strings.TrimPrefix(key, REDISKEY_DICT_WORDS_PREFIX))
+        }
+    }
+    sort.Strings(result)
+    return result
+}
+
+func (s *MemoryStore) GetDictWords() []string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var result []string
+    for word := range s.sets[REDISKEY_DICT_EXISTS] {
+        result = append(result, word)
+    }
+    return result
+}
+
+func (s *MemoryStore) GetDictItem(word string) DictItemRedis {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    item := DictItemRedis{}
+    scanFields(s.hash(REDISKEY_DICT_ITEM_PREFIX + word, false), &item)
+    return item
+}
+
+func (s *MemoryStore) AddVisitor(key string, visitor string, expire time.Time) (bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, ok := s.sets[key]; !ok {
+        now := time.Now()
+        for k := range s.sets {
+            if t, ok := s.expires[k]; ok && !now.Before(t) {
+                delete(s.sets, k)
+                delete(s.expires, k)
+            }
+        }
+    }
+    visitors := s.set(key)
+    s.expires[key] = expire
+    if visitors[visitor] {
+        return false, nil
+    }
+    visitors[visitor] = true
+    return true, nil
+}
+
+func (s *MemoryStore) AddSearchItem(keyname string, tokens []string, score float64) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, token := range tokens {
+        s.zset(REDISKEY_SEARCH_TOKEN_PREFIX + token)[keyname] = score
+        s.set(REDISKEY_SEARCH_ITEM_PREFIX + keyname)[token] = true
+    }
+    return nil
+}
+
+func (s *MemoryStore) RemoveSearchItem(keyname string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for token := range s.sets[REDISKEY_SEARCH_ITEM_PREFIX + keyname] {
+        index := REDISKEY_SEARCH_TOKEN_PREFIX + token
+        delete(s.zsets[index], keyname)
+        if len(s.zsets[index]) == 0 {
+            delete(s.zsets, index)
+        }
+    }
+    delete(s.sets, REDISKEY_SEARCH_ITEM_PREFIX + keyname)
+    return nil
+}
+
+func (s *MemoryStore) SearchItems(indexes []string, min float64, max float64, offset int, count int) []string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var zsets []map[string]float64
+    for _, index := range indexes {
+        zsets = append(zsets, s.zsets[index])
+    }
+    return getScoreRange(interZsets(zsets), min, max, offset, count)
+}
+
+func (s *MemoryStore) IncrCounter(key string, n int) (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.counters[key] += n
+    return s.counters[key], nil
+}
+
+func (s *MemoryStore) GetCounter(key string) int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.counters[key]
+}
+
+func (s *MemoryStore) SetCounter(key string, n int) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.counters[key] = n
+    return nil
+}
+
+func (s *MemoryStore) DeleteCounter(keys ...string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, key := range keys {
+        delete(s.counters, key)
+    }
+    return nil
+}
+
+// interZsets returns the members found in every zset with their highest
+// score, sorted like ZREVRANGE.
+func interZsets(zsets []map[string]float64) []scoredMember {
+    var result []scoredMember
+    if len(zsets) == 0 {
+        return result
+    }
+    for member, score := range zsets[0] {
+        found := true
+        for _, z := range zsets[1:] {
+            other, ok := z[member]
+            if !ok {
+                found = false
+                break
+            }
+            score = math.Max(score, other)
+        }
+        if found {
+            result = append(result, scoredMember{member, score})
+        }
+    }
+    sort.Sort(byScoreDesc(result))
+    return result
+}
+
+// getScoreRange applies ZREVRANGEBYSCORE style bounds and LIMIT to sorted
+// members.
+func getScoreRange(members []scoredMember, min float64, max float64, offset int, count int) []string {
+    var result []string
+    for _, m := range members {
+        if m.Score < min || m.Score > max {
+            continue
+        }
+        if offset > 0 {
+            offset--
+            continue
+        }
+        if count >= 0 && len(result) >= count {
+            break
+        }
+        result = append(result, m.Member)
+    }
+    return result
+}
+
+// getRangeBounds resolves ZRANGE style start/stop, where negative values
+// count from the end, into valid slice indexes. stop < start means empty.
+func getRangeBounds(length int, start int, stop int) (int, int) {
+    if start < 0 {
+        start += length
+    }
+    if stop < 0 {
+        stop += length
+    }
+    if start < 0 {
+        start = 0
+    }
+    if stop >= length {
+        stop = length - 1
+    }
+    return start, stop
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+    "sort"
+    "time"
+    "github.com/garyburd/redigo/redis"
+)
+
+const (
+    DEFAULT_REDIS_MAX_IDLE        = 3
+    DEFAULT_REDIS_MAX_ACTIVE      = 16
+    DEFAULT_REDIS_IDLE_TIMEOUT    = 240
+    DEFAULT_REDIS_CONNECT_TIMEOUT = 5
+    DEFAULT_REDIS_IO_TIMEOUT      = 10
+)
+
+type RedisStore struct {
+    *redis.Pool
+}
+
+// NewRedisPool selects the database when a connection is dialed, so every
+// connection handed out by the pool is ready to use. Callers must Close
+// the connections they Get.
+func NewRedisPool(conf ConfigRedis) *redis.Pool {
+    return &redis.Pool {
+        MaxIdle:     GetConfigInt(conf.MaxIdle, DEFAULT_REDIS_MAX_IDLE),
+        MaxActive:   GetConfigInt(conf.MaxActive, DEFAULT_REDIS_MAX_ACTIVE),
+        IdleTimeout: time.Duration(GetConfigInt(conf.IdleTimeout, DEFAULT_REDIS_IDLE_TIMEOUT)) * time.Second,
+        Wait:        true,
+        Dial: func() (redis.Conn, error) {
+            return redis.Dial(conf.Protocol, conf.Server,
+                redis.DialDatabase(conf.DatabaseNo),
+                redis.DialConnectTimeout(time.Duration(GetConfigInt(conf.ConnectTimeout, DEFAULT_REDIS_CONNECT_TIMEOUT)) * time.Second),
+                redis.DialReadTimeout(time.Duration(GetConfigInt(conf.ReadTimeout, DEFAULT_REDIS_IO_TIMEOUT)) * time.Second),
+                redis.DialWriteTimeout(time.Duration(GetConfigInt(conf.WriteTimeout, DEFAULT_REDIS_IO_TIMEOUT)) * time.Second))
+        },
+        TestOnBorrow: func(c redis.Conn, t time.Time) error {
+            if time.Since(t) < time.Minute {
+                return nil
+            }
+            _, err := c.Do("PING")
+            return err
+        },
+    }
+}
+
+func NewRedisStore(conf ConfigRedis) *RedisStore {
+    return &RedisStore{NewRedisPool(conf)}
+}
+
+func (s *RedisStore) Ping() error {
+    _, err := s.Do("PING")
+    return err
+}
+
+// Do runs a single command on a connection borrowed for just that command.
+func (s *RedisStore) Do(command string, args ...interface{}) (interface{}, error) {
+    con := s.Get()
+    defer con.Close()
+    return con.Do(command, args...)
+}
+
+// addItemScript allocates the item ID from the feed:id counter and writes
+// the item and its indexes in one step, so concurrent updaters can never
+// hand out the same ID. The counter is seeded from SCARD feed:exists to
+// continue where the old numbering left off, and IDs whose hash still
+// exists are skipped. feed:links remembers the links of every item so the
+// retention job can clean feed:exists once the hash has expired.
+//
+// KEYS: feed:id, feed:exists, feed:links, time indexes...
+// ARGV: item key prefix, links separated by spaces, score, expire at, fields...
+var addItemScript = redis.NewScript(-1, `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+    redis.call('SET', KEYS[1], redis.call('SCARD', KEYS[2]))
+end
+local id, key
+repeat
+    id = redis.call('INCR', KEYS[1])
+    key = ARGV[1] .. id
+until redis.call('EXISTS', key) == 0
+for link in string.gmatch(ARGV[2], '%S+') do
+    redis.call('SADD', KEYS[2], link)
+end
+redis.call('HSET', KEYS[3], key, ARGV[2])
+for i = 4, #KEYS do
+    redis.call('ZADD', KEYS[i], ARGV[3], key)
+end
+redis.call('HMSET', key, unpack(ARGV, 5))
+redis.call('HSET', key, 'id', id)
+redis.call('EXPIREAT', key, ARGV[4])
+return id
+`)
+
+func (s *RedisStore) AddItem(item ItemRedis, links []string, score float64, expire time.Time, indexes []string) (int, error) {
+    con := s.Get()
+    defer con.Close()
+    args := redis.Args{3 + len(indexes), REDISKEY_FEED_ID, REDISKEY_FEED_EXISTS, REDISKEY_FEED_LINKS}
+    for _, index := range indexes {
+        args = args.Add(index)
+    }
+    args = args.Add(REDISKEY_FEED_ITEM_PREFIX, JoinItemLinks(links), FormatScore(score), expire.Unix())
+    return redis.Int(addItemScript.Do(con, args.AddFlat(item)...))
+}
+
+func (s *RedisStore) GetItem(keyname string) (ItemRedis, bool) {
+    item := ItemRedis{}
+    values, err := redis.Values(s.Do("HGETALL", keyname))
+    if err != nil || len(values) == 0 {
+        return item, false
+    }
+    redis.ScanStruct(values, &item)
+    return item, true
+}
+
+func (s *RedisStore) GetItemKeys() []string {
+    con := s.Get()
+    defer con.Close()
+    return scanKeys(con, REDISKEY_FEED_ITEM_PREFIX + "*")
+}
+
+func (s *RedisStore) GetItemsField(keynames []string, field string) []string {
+    con := s.Get()
+    defer con.Close()
+    for _, keyname := range keynames {
+        con.Send("HGET", keyname, field)
+    }
+    con.Flush()
+    result := make([]string, len(keynames))
+    for i := range keynames {
+        result[i], _ = redis.String(con.Receive())
+    }
+    return result
+}
+
+func (s *RedisStore) SetItemField(keyname string, field string, value interface{}) error {
+    _, err := s.Do("HSET", keyname, field, value)
+    return err
+}
+
+func (s *RedisStore) IncrItemField(keyname string, field string, n int) error {
+    _, err := s.Do("HINCRBY", keyname, field, n)
+    return err
+}
+
+func (s *RedisStore) IsKeyExists(keyname string) bool {
+    result, _ := redis.Int(s.Do("EXISTS", keyname))
+    return result == 1
+}
+
+func (s *RedisStore) IsItemExists(link string) bool {
+    result, _ := redis.Int(s.Do("SISMEMBER", REDISKEY_FEED_EXISTS, link))
+    return result == 1
+}
+
+func (s *RedisStore) GetItemLinks() []string {
+    result, _ := redis.Strings(s.Do("SMEMBERS", REDISKEY_FEED_EXISTS))
+    return result
+}
+
+func (s *RedisStore) GetItemLink(keyname string) []string {
+    result, _ := redis.String(s.Do("HGET", REDISKEY_FEED_LINKS, keyname))
+    return SplitItemLinks(result)
+}
+
+func (s *RedisStore) SetItemLink(keyname string, links []string) error {
+    _, err := s.Do("HSET", REDISKEY_FEED_LINKS, keyname, JoinItemLinks(links))
+    return err
+}
+
+func (s *RedisStore) RemoveItemLink(keyname string, links []string) error {
+    con := s.Get()
+    defer con.Close()
+    con.Send("MULTI")
+    if len(links) > 0 {
+        con.Send("SREM", redis.Args{REDISKEY_FEED_EXISTS}.AddFlat(links)...)
+    }
+    con.Send("HDEL", REDISKEY_FEED_LINKS, keyname)
+    _, err := con.Do("EXEC")
+    return err
+}
+
+func (s *RedisStore) RemoveLinks(links ...string) error {
+    if len(links) == 0 {
+        return nil
+    }
+    _, err := s.Do("SREM", redis.Args{REDISKEY_FEED_EXISTS}.AddFlat(links)...)
+    return err
+}
+
+func (s *RedisStore) GetChannelState(url string) ChannelState {
+    state := ChannelState{}
+    values, _ := redis.Values(s.Do("HGETALL", GetChannelKeyname(url)))
+    redis.ScanStruct(values, &state)
+    return state
+}
+
+func (s *RedisStore) SetChannelState(state ChannelState) error {
+    _, err := s.Do("HMSET", redis.Args{GetChannelKeyname(state.Url)}.AddFlat(state)...)
+    return err
+}
+
+func (s *RedisStore) AddIndex(index string, score float64, keyname string) error {
+    _, err := s.Do("ZADD", index, FormatScore(score), keyname)
+    return err
+}
+
+func (s *RedisStore) RemoveIndex(keyname string, indexes ...string) error {
+    con := s.Get()
+    defer con.Close()
+    con.Send("MULTI")
+    for _, index := range indexes {
+        con.Send("ZREM", index, keyname)
+    }
+    _, err := con.Do("EXEC")
+    return err
+}
+
+func (s *RedisStore) GetIndexScore(index string, keyname string) (float64, bool) {
+    score, err := redis.Float64(s.Do("ZSCORE", index, keyname))
+    return score, err == nil
+}
+
+func (s *RedisStore) GetIndexRange(index string, min float64, max float64, offset int, count int) []string {
+    result, _ := redis.Strings(s.Do("ZREVRANGEBYSCORE", index, FormatScore(max), FormatScore(min), "LIMIT", offset, count))
+    return result
+}
+
+func (s *RedisStore) IncrRank(rankkey string, keyname string, n float64) error {
+    _, err := s.Do("ZINCRBY", rankkey, n, keyname)
+    return err
+}
+
+func (s *RedisStore) UnionRank(dest string, rankkeys []string, weights []float64) error {
+    args := redis.Args{dest, len(rankkeys)}.AddFlat(rankkeys)
+    if weights != nil {
+        args = args.Add("WEIGHTS").AddFlat(weights)
+    }
+    _, err := s.Do("ZUNIONSTORE", args...)
+    return err
+}
+
+func (s *RedisStore) FilterRank(dest string, rankkey string, index string) error {
+    _, err := s.Do("ZINTERSTORE", dest, 2, index, rankkey, "WEIGHTS", 0, 1)
+    return err
+}
+
+func (s *RedisStore) GetRankRange(rankkey string, start int, stop int) []string {
+    result, _ := redis.Strings(s.Do("ZREVRANGE", rankkey, start, stop))
+    return result
+}
+
+func (s *RedisStore) GetRankScore(rankkey string, keyname string) (float64, bool) {
+    return s.GetIndexScore(rankkey, keyname)
+}
+
+func (s *RedisStore) GetRankScores(rankkey string) map[string]float64 {
+    result := make(map[string]float64)
+    values, _ := redis.Strings(s.Do("ZRANGE", rankkey, 0, -1, "WITHSCORES"))
+    for i := 0; i + 1 < len(values); i += 2 {
+        result[values[i]] = ParseScore(values[i + 1])
+    }
+    return result
+}
+
+func (s *RedisStore) SetRank(rankkey string, scores map[string]float64) error {
+    con := s.Get()
+    defer con.Close()
+    con.Send("MULTI")
+    con.Send("DEL", rankkey)
+    if len(scores) > 0 {
+        args := redis.Args{rankkey}
+        for member, score := range scores {
+            args = args.Add(FormatScore(score), member)
+        }
+        con.Send("ZADD", args...)
+    }
+    _, err := con.Do("EXEC")
+    return err
+}
+
+func (s *RedisStore) GetRankKeys() []string {
+    con := s.Get()
+    defer con.Close()
+    return scanKeys(con, REDISKEY_FEED_RANK_PREFIX + "*")
+}
+
+func (s *RedisStore) RemoveRank(keyname string, rankkeys ...string) error {
+    return s.RemoveIndex(keyname, rankkeys...)
+}
+
+func (s *RedisStore) DeleteRank(rankkeys ...string) error {
+    if len(rankkeys) == 0 {
+        return nil
+    }
+    _, err := s.Do("DEL", redis.Args{}.AddFlat(rankkeys)...)
+    return err
+}
+
+func (s *RedisStore) AddDictItem(word string, item DictItemRedis) error {
+    con := s.Get()
+    defer con.Close()
+    others, err := getOtherDictWords(con, item.Dict, []string{word})
+    if err != nil {
+        return err
+    }
+    con.Send("MULTI")
+    con.Send("SADD", REDISKEY_DICT_NAMES, item.Dict)
+    con.Send("SADD", REDISKEY_DICT_WORDS_PREFIX + item.Dict, word)
+    con.Send("HMSET", redis.Args{GetDictEntryKeyname(item.Dict, word)}.AddFlat(item)...)
+    if len(others[word]) == 0 {
+        con.Send("SADD", REDISKEY_DICT_EXISTS, word)
+        con.Send("HMSET", redis.Args{REDISKEY_DICT_ITEM_PREFIX + word}.AddFlat(item)...)
+    }
+    _, err = con.Do("EXEC")
+    return err
+}
+
+func (s *RedisStore) ReplaceDictItems(dict string, items map[string]DictItemRedis) error {
+    con := s.Get()
+    defer con.Close()
+    old, err := redis.Strings(con.Do("SMEMBERS", REDISKEY_DICT_WORDS_PREFIX + dict))
+    if err != nil {
+        return err
+    }
+    words := old
+    for word := range items {
+        words = append(words, word)
+    }
+    others, err := getOtherDictWords(con, dict, words)
+    if err != nil {
+        return err
+    }
+    // Details of the dictionaries taking over the words dict drops.
+    takeover := make(map[string][]interface{})
+    for _, word := range old {
+        if _, ok := items[word]; ok {
+            continue
+        }
+        for _, other := range others[word] {
+            values, err := redis.Values(con.Do("HGETALL", GetDictEntryKeyname(other, word)))
+            if err != nil {
+                return err
+            }
+            if len(values) > 0 {
+                takeover[word] = values
+                break
+            }
+        }
+    }
+    con.Send("MULTI")
+    for _, word := range old {
+        if _, ok := items[word]; ok {
+            continue
+        }
+        con.Send("DEL", GetDictEntryKeyname(dict, word))
+        if len(others[word]) == 0 {
+            con.Send("SREM", REDISKEY_DICT_EXISTS, word)
+            con.Send("DEL", REDISKEY_DICT_ITEM_PREFIX + word)
+        } else if values, ok := takeover[word]; ok {
+            con.Send("DEL", REDISKEY_DICT_ITEM_PREFIX + word)
+            con.Send("HMSET", redis.Args{REDISKEY_DICT_ITEM_PREFIX + word}.Add(values...)...)
+        }
+    }
+    con.Send("SADD", REDISKEY_DICT_NAMES, dict)
+    con.Send("DEL", REDISKEY_DICT_WORDS_PREFIX + dict)
+    for word, item := range items {
+        con.Send("SADD", REDISKEY_DICT_WORDS_PREFIX + dict, word)
+        con.Send("DEL", GetDictEntryKeyname(dict, word))
+        con.Send("HMSET", redis.Args{GetDictEntryKeyname(dict, word)}.AddFlat(item)...)
+        if len(others[word]) > 0 {
+            continue
+        }
+        con.Send("SADD", REDISKEY_DICT_EXISTS, word)
+        con.Send("DEL", REDISKEY_DICT_ITEM_PREFIX + word)
+        con.Send("HMSET", redis.Args{REDISKEY_DICT_ITEM_PREFIX + word}.AddFlat(item)...)
+    }
+    _, err = con.Do("EXEC")
+    return err
+}
+
+// getOtherDictWords returns, for each of words, the dictionaries other
+// than dict whose dict:words set lists it, in name order. Dictionaries are
+// found through dict:names, which every write of a dict:words set adds to,
+// so adding a single word does not scan the keyspace.
+func getOtherDictWords(con redis.Conn, dict string, words []string) (map[string][]string, error) {
+    names, err := redis.Strings(con.Do("SMEMBERS", REDISKEY_DICT_NAMES))
+    if err != nil {
+        return nil, err
+    }
+    sort.Strings(names)
+    var sent []string
+    for _, name := range names {
+        if name == dict {
+            continue
+        }
+        for _, word := range words {
+            con.Send("SISMEMBER", REDISKEY_DICT_WORDS_PREFIX + name, word)
+        }
+        sent = append(sent, name)
+    }
+    if err := con.Flush(); err != nil {
+        return nil, err
+    }
+    result := make(map[string][]string)
+    for _, name := range sent {
+        for _, word := range words {
+            listed, err := redis.Bool(con.Receive())
+            if err != nil {
+                return nil, err
+            }
+            if listed {
+                result[word] = append(result[word], name)
+            }
+        }
+    }
+    return result, nil
+}
+
+func (s *RedisStore) GetDictWords() []string {
+    result, _ := redis.Strings(s.Do("SMEMBERS", REDISKEY_DICT_EXISTS))
+    return result
+}
+
+func (s *RedisStore) GetDictItem(word string) DictItemRedis {
+    item := DictItemRedis{}
+    values, _ := redis.Values(s.Do("HGETALL", REDISKEY_DICT_ITEM_PREFIX + word))
+    redis.ScanStruct(values, &item)
+    return item
+}
+
+func (s *RedisStore) IncrCounter(key string, n int) (int, error) {
+    return redis.Int(s.Do("INCRBY", key, n))
+}
+
+func (s *RedisStore) GetCounter(key string) int {
+    result, _ := redis.Int(s.Do("GET", key))
+    return result
+}
+
+func (s *RedisStore) SetCounter(key string, n int) error {
+    _, err := s.Do("SET", key, n)
+    return err
+}
+
+func (s *RedisStore) DeleteCounter(keys ...string) error {
+    if len(keys) == 0 {
+        return nil
+    }
+    _, err := s.Do("DEL", redis.Args{}.AddFlat(keys)...)
+    return err
+}
+
+// AddVisitor uses a HyperLogLog, so a new visitor is very rarely taken for
+// a known one.
+func (s *RedisStore) AddVisitor(key string, visitor string, expire time.Time) (bool, error) {
+    con := s.Get()
+    defer con.Close()
+    con.Send("MULTI")
+    con.Send("PFADD", key, visitor)
+    con.Send("EXPIREAT", key, expire.Unix())
+    values, err := redis.Values(con.Do("EXEC"))
+    if err != nil || len(values) != 2 {
+        return false, err
+    }
+    added, err := redis.Int(values[0], nil)
+    return added == 1, err
+}
+
+func (s *RedisStore) AddSearchItem(keyname string, tokens []string, score float64) error {
+    if len(tokens) == 0 {
+        return nil
+    }
+    con := s.Get()
+    defer con.Close()
+    con.Send("MULTI")
+    for _, token := range tokens {
+        con.Send("ZADD", REDISKEY_SEARCH_TOKEN_PREFIX + token, FormatScore(score), keyname)
+    }
+    con.Send("SADD", redis.Args{REDISKEY_SEARCH_ITEM_PREFIX + keyname}.AddFlat(tokens)...)
+    _, err := con.Do("EXEC")
+    return err
+}
+
+func (s *RedisStore) RemoveSearchItem(keyname string) error {
+    con := s.Get()
+    defer con.Close()
+    tokens, err := redis.Strings(con.Do("SMEMBERS", REDISKEY_SEARCH_ITEM_PREFIX + keyname))
+    if err != nil {
+        return err
+    }
+    con.Send("MULTI")
+    for _, token := range tokens {
+        con.Send("ZREM", REDISKEY_SEARCH_TOKEN_PREFIX + token, keyname)
+    }
+    con.Send("DEL", REDISKEY_SEARCH_ITEM_PREFIX + keyname)
+    _, err = con.Do("EXEC")
+    return err
+}
+
+// SearchItems intersects the indexes into a temporary key inside MULTI, so
+// concurrent searches never see each other's result.
+func (s *RedisStore) SearchItems(indexes []string, min float64, max float64, offset int, count int) []string {
+    if len(indexes) == 0 {
+        return nil
+    }
+    con := s.Get()
+    defer con.Close()
+    con.Send("MULTI")
+    con.Send("ZINTERSTORE", redis.Args{REDISKEY_SEARCH_TEMP, len(indexes)}.AddFlat(indexes).Add("AGGREGATE", "MAX")...)
+    con.Send("ZREVRANGEBYSCORE", REDISKEY_SEARCH_TEMP, FormatScore(max), FormatScore(min), "LIMIT", offset, count)
+    con.Send("DEL", REDISKEY_SEARCH_TEMP)
+    values, err := redis.Values(con.Do("EXEC"))
+    if err != nil || len(values) != 3 {
+        return nil
+    }
+    result, _ := redis.Strings(values[1], nil)
+    return result
+}
+
+func scanKeys(con redis.Conn, pattern string) []string {
+    var result []string
+    cursor := 0
+    for {
+        values, err := redis.Values(con.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+        if err != nil || len(values) != 2 {
+            return result
+        }
+        cursor, _ = redis.Int(values[0], nil)
+        keys, _ := redis.Strings(values[1], nil)
+        result = append(result, keys...)
+        if cursor == 0 {
+            return result
+        }
+    }
+}
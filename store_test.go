@@ -0,0 +1,330 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "testing"
+    "time"
+    "github.com/Sirupsen/logrus"
+)
+
+func NewTestUserConfig() *UserConfig {
+    userconf := &UserConfig{}
+    userconf.Site.Title = "colle"
+    userconf.Site.Url = "http://example.com"
+    userconf.Site.ItemDays = 7
+    userconf.Site.ItemExpire = 30
+    userconf.Site.PageNewItemCount = 10
+    userconf.Site.PageRankItemCount = 10
+    userconf.Feed.Category = []ChannelCategory{{Dir: "news", Label: "News"}}
+    userconf.Click.DisableFilter = true
+    return userconf
+}
+
+func NewTestDataManager(store Store) *DataManager {
+    logger := logrus.New()
+    logger.Out = ioutil.Discard
+    return &DataManager{store, NewTestUserConfig(), logger, ""}
+}
+
+// GetTestStores returns a fresh store of every backend that runs without
+// a server, so each test checks that they behave the same.
+func GetTestStores(t *testing.T) map[string]Store {
+    dir, err := ioutil.TempDir("", "colle")
+    if err != nil {
+        t.Fatal(err)
+    }
+    bolt, err := NewBoltStore(filepath.Join(dir, "colle.db"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        bolt.Close()
+        os.RemoveAll(dir)
+    })
+    return map[string]Store{STORAGE_MEMORY: NewMemoryStore(), STORAGE_BOLT: bolt}
+}
+
+func NewTestFeed(titles ...string) Feed {
+    feed := Feed{Title: "Example", Link: "http://news.example.com/"}
+    for i, title := range titles {
+        feed.Entries = append(feed.Entries, Entrie{
+            Title:          title,
+            Link:           "http://news.example.com/" + strconv.Itoa(i),
+            PublishedDate:  time.Now().Add(time.Duration(i - len(titles)) * time.Minute).Format(time.RFC1123Z),
+            ContentSnippet: title,
+        })
+    }
+    return feed
+}
+
+func GetItemTitles(items []Item) []string {
+    var result []string
+    for _, item := range items {
+        result = append(result, item.Title)
+    }
+    return result
+}
+
+func TestSetFeedItems(t *testing.T) {
+    for name, store := range GetTestStores(t) {
+        dm := NewTestDataManager(store)
+        channel := Channel{Url: "http://news.example.com/rss", Category: "news"}
+        feed := NewTestFeed("Tokyo stocks rise", "Rain expected in Osaka")
+        canonicalizer := NewCanonicalizer(dm.UserConfig.Feed.Canonical, 0)
+        if n, err := dm.SetFeedItems(channel, feed, nil, canonicalizer); n != 2 || err != nil {
+            t.Errorf("%s: added %d items, want 2", name, n)
+        }
+        if n, _ := dm.SetFeedItems(channel, feed, nil, canonicalizer); n != 0 {
+            t.Errorf("%s: added %d known items again", name, n)
+        }
+        want := []string{"Rain expected in Osaka", "Tokyo stocks rise"}
+        for _, category := range []string{"", "news"} {
+            items := dm.GetPageFeedItem(1, category, dm.UserConfig.Site.ItemDays, dm.UserConfig.Site.PageNewItemCount)
+            if got := GetItemTitles(items); !EqualStrings(got, want) {
+                t.Errorf("%s: page of %q = %v, want %v", name, category, got, want)
+            }
+        }
+        if items := dm.GetPageFeedItem(1, "sports", dm.UserConfig.Site.ItemDays, dm.UserConfig.Site.PageNewItemCount); len(items) != 0 {
+            t.Errorf("%s: page of another category = %v", name, GetItemTitles(items))
+        }
+    }
+}
+
+// With resolveCanonical the raw, canonicalized and resolved links are all
+// recorded and pruned with the item; entries the dictionary drops are never
+// resolved.
+func TestSetFeedItemsResolve(t *testing.T) {
+    requests := 0
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        requests++
+        fmt.Fprint(w, `<html><head><link rel="canonical" href="https://canonical.example.com/story"></head></html>`)
+    }))
+    defer server.Close()
+    for name, store := range GetTestStores(t) {
+        requests = 0
+        dm := NewTestDataManager(store)
+        dm.UserConfig.Feed.Canonical.ResolveCanonical = true
+        dm.UserConfig.Feed.Cluster.Disable = true
+        canonicalizer := NewCanonicalizer(dm.UserConfig.Feed.Canonical, 0)
+        feed := NewTestFeed("Tokyo stocks rise")
+        feed.Entries[0].Link = server.URL + "/story?utm_source=rss"
+        feed.Entries[0].PublishedDate = time.Now().AddDate(0, 0, -dm.UserConfig.Site.ItemExpire - 1).Format(time.RFC1123Z)
+        dm.SetFeedItems(Channel{IsDict: true}, feed, NewMatcher([]string{"Osaka"}), canonicalizer)
+        if requests != 0 {
+            t.Errorf("%s: resolved %d entries the dictionary dropped", name, requests)
+        }
+        dm.SetFeedItems(Channel{}, feed, nil, canonicalizer)
+        links := []string{"https://canonical.example.com/story", feed.Entries[0].Link, canonicalizer.Canonicalize(feed.Entries[0].Link)}
+        if got := store.GetItemLink(REDISKEY_FEED_ITEM_PREFIX + "1"); !EqualStrings(got, links) {
+            t.Errorf("%s: feed:links = %v, want %v", name, got, links)
+        }
+        for _, link := range links {
+            if !dm.IsItemExists(link) {
+                t.Errorf("%s: %s is not in feed:exists", name, link)
+            }
+        }
+        if report := dm.PruneItems(false); report.Links != 3 {
+            t.Errorf("%s: pruned %d links, want 3", name, report.Links)
+        }
+        if got := store.GetItemLinks(); len(got) != 0 {
+            t.Errorf("%s: feed:exists after pruning = %v", name, got)
+        }
+    }
+}
+
+// failingStore fails to add items while fail is set.
+type failingStore struct {
+    Store
+    fail bool
+}
+
+func (s *failingStore) AddItem(item ItemRedis, links []string, score float64, expire time.Time, indexes []string) (int, error) {
+    if s.fail {
+        return 0, errors.New("store unavailable")
+    }
+    return s.Store.AddItem(item, links, score, expire, indexes)
+}
+
+// The validators of a feed are only saved once its entries are stored, so
+// entries that failed are fetched again instead of coming back as 304.
+func TestSetFeedValidators(t *testing.T) {
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Header.Get("If-None-Match") == `"v1"` {
+            w.WriteHeader(http.StatusNotModified)
+            return
+        }
+        w.Header().Set("ETag", `"v1"`)
+        fmt.Fprint(w, testRss2)
+    }))
+    defer server.Close()
+    store := &failingStore{NewMemoryStore(), true}
+    dm := NewTestDataManager(store)
+    channel := []Channel{{Url: server.URL, Category: "news"}}
+    dm.SetFeed(channel)
+    if state := dm.GetChannelState(channel[0]); state.ETag != "" || state.NewItemCount != 0 {
+        t.Errorf("failed store saved etag %q, %d items", state.ETag, state.NewItemCount)
+    }
+    store.fail = false
+    dm.SetFeed(channel)
+    if state := dm.GetChannelState(channel[0]); state.ETag != `"v1"` || state.NewItemCount != 2 {
+        t.Errorf("etag %q, %d items, want %q, 2", state.ETag, state.NewItemCount, `"v1"`)
+    }
+}
+
+func TestSetItem(t *testing.T) {
+    for name, store := range GetTestStores(t) {
+        dm := NewTestDataManager(store)
+        first, _ := dm.SetItem(ItemRedis{Title: "a", Link: "http://a.example.com/", PubDate: time.Now().Format(time.RFC1123Z)})
+        second, _ := dm.SetItem(ItemRedis{Title: "b", Link: "http://b.example.com/", PubDate: time.Now().Format(time.RFC1123Z)})
+        if first != 1 || second != 2 {
+            t.Errorf("%s: ids %d, %d, want 1, 2", name, first, second)
+        }
+        item := dm.GetItem(REDISKEY_FEED_ITEM_PREFIX + "2")
+        if item.Id != 2 || item.Title != "b" {
+            t.Errorf("%s: item 2 = %d %q", name, item.Id, item.Title)
+        }
+        if !dm.IsItemExists("http://a.example.com/") || dm.IsItemExists("http://c.example.com/") {
+            t.Errorf("%s: wrong feed:exists", name)
+        }
+        if links := store.GetItemLink(REDISKEY_FEED_ITEM_PREFIX + "1"); !EqualStrings(links, []string{"http://a.example.com/"}) {
+            t.Errorf("%s: feed:links of item 1 = %v", name, links)
+        }
+    }
+}
+
+// Items stored before story clustering are listed from feed:time until the
+// first update builds the story index.
+func TestSetStoryIndex(t *testing.T) {
+    for name, store := range GetTestStores(t) {
+        dm := NewTestDataManager(store)
+        dm.UserConfig.Feed.Cluster.Disable = true
+        dm.SetFeedItems(Channel{}, NewTestFeed("Tokyo stocks rise", "Rain expected in Osaka"), nil, NewCanonicalizer(dm.UserConfig.Feed.Canonical, 0))
+        dm.UserConfig.Feed.Cluster.Disable = false
+        if items := dm.GetPageFeedItem(1, "", dm.UserConfig.Site.ItemDays, 10); len(items) != 2 {
+            t.Errorf("%s: %d items before the story index, want 2", name, len(items))
+        }
+        if n := dm.SetStoryIndex(); n != 2 {
+            t.Errorf("%s: indexed %d stories, want 2", name, n)
+        }
+        if n := dm.SetStoryIndex(); n != 0 {
+            t.Errorf("%s: indexed %d stories again", name, n)
+        }
+        if dm.GetStoryKeyname("") != REDISKEY_FEED_STORY {
+            t.Errorf("%s: pages do not use the story index", name)
+        }
+        if items := dm.GetPageFeedItem(1, "", dm.UserConfig.Site.ItemDays, 10); len(items) != 2 {
+            t.Errorf("%s: %d items after the story index, want 2", name, len(items))
+        }
+    }
+}
+
+func TestReplaceDictItems(t *testing.T) {
+    for name, store := range GetTestStores(t) {
+        store.ReplaceDictItems(DICT_LOCAL, map[string]DictItemRedis{
+            "alpha": {Dict: DICT_LOCAL, AffiliateURL: "http://example.com/alpha"},
+            "beta":  {Dict: DICT_LOCAL},
+        })
+        store.ReplaceDictItems(DICT_LOCAL, map[string]DictItemRedis{
+            "beta":  {Dict: DICT_LOCAL, AffiliateURL: "http://example.com/beta"},
+            "gamma": {Dict: DICT_LOCAL},
+        })
+        words := store.GetDictWords()
+        sort.Strings(words)
+        if want := []string{"beta", "gamma"}; !EqualStrings(words, want) {
+            t.Errorf("%s: words = %v, want %v", name, words, want)
+        }
+        if item := store.GetDictItem("alpha"); item.AffiliateURL != "" {
+            t.Errorf("%s: removed word kept %+v", name, item)
+        }
+        if item := store.GetDictItem("beta"); item.AffiliateURL != "http://example.com/beta" {
+            t.Errorf("%s: beta = %+v", name, item)
+        }
+    }
+}
+
+// Words of another dictionary stay as that dictionary stored them when the
+// local one lists or drops them.
+func TestReplaceDictItemsShared(t *testing.T) {
+    for name, store := range GetTestStores(t) {
+        store.AddDictItem("shared", DictItemRedis{Dict: DICT_DMMR18ACT, AffiliateURL: "http://dmm.example.com/shared"})
+        store.ReplaceDictItems(DICT_LOCAL, map[string]DictItemRedis{
+            "shared": {Dict: DICT_LOCAL, AffiliateURL: "http://example.com/shared"},
+            "local":  {Dict: DICT_LOCAL},
+        })
+        if item := store.GetDictItem("shared"); item.AffiliateURL != "http://dmm.example.com/shared" {
+            t.Errorf("%s: listing overwrote %+v", name, item)
+        }
+        store.ReplaceDictItems(DICT_LOCAL, map[string]DictItemRedis{})
+        words := store.GetDictWords()
+        if want := []string{"shared"}; !EqualStrings(words, want) {
+            t.Errorf("%s: words = %v, want %v", name, words, want)
+        }
+        if item := store.GetDictItem("shared"); item.AffiliateURL != "http://dmm.example.com/shared" {
+            t.Errorf("%s: dropping removed %+v", name, item)
+        }
+    }
+}
+
+// When the dictionary whose details are shown drops a word another one
+// still lists, the word shows that dictionary's details until it drops the
+// word too.
+func TestReplaceDictItemsOwner(t *testing.T) {
+    for name, store := range GetTestStores(t) {
+        steps := []struct {
+            dict  string
+            items map[string]DictItemRedis
+            words []string
+            url   string
+        }{
+            {DICT_LOCAL, map[string]DictItemRedis{"word": {Dict: DICT_LOCAL, AffiliateURL: "http://example.com/word"}}, []string{"word"}, "http://example.com/word"},
+            {DICT_DMMR18ACT, map[string]DictItemRedis{"word": {Dict: DICT_DMMR18ACT, AffiliateURL: "http://dmm.example.com/word"}}, []string{"word"}, "http://example.com/word"},
+            {DICT_LOCAL, map[string]DictItemRedis{}, []string{"word"}, "http://dmm.example.com/word"},
+            {DICT_DMMR18ACT, map[string]DictItemRedis{}, nil, ""},
+        }
+        for i, step := range steps {
+            store.ReplaceDictItems(step.dict, step.items)
+            if words := store.GetDictWords(); !EqualStrings(words, step.words) {
+                t.Errorf("%s: step %d: words = %v, want %v", name, i, words, step.words)
+            }
+            if item := store.GetDictItem("word"); item.AffiliateURL != step.url {
+                t.Errorf("%s: step %d: word = %+v, want %q", name, i, item, step.url)
+            }
+        }
+    }
+}
+
+// Words added one by one, as the DMM dictionary does, leave the details of
+// a word another dictionary lists alone and take over once it drops them.
+func TestAddDictItemOwner(t *testing.T) {
+    for name, store := range GetTestStores(t) {
+        store.ReplaceDictItems(DICT_LOCAL, map[string]DictItemRedis{"word": {Dict: DICT_LOCAL, AffiliateURL: "http://example.com/word"}})
+        store.AddDictItem("word", DictItemRedis{Dict: DICT_DMMR18ACT, AffiliateURL: "http://dmm.example.com/word"})
+        if item := store.GetDictItem("word"); item.AffiliateURL != "http://example.com/word" {
+            t.Errorf("%s: adding overwrote %+v", name, item)
+        }
+        store.ReplaceDictItems(DICT_LOCAL, map[string]DictItemRedis{})
+        if item := store.GetDictItem("word"); item.AffiliateURL != "http://dmm.example.com/word" {
+            t.Errorf("%s: word = %+v after the local dictionary dropped it", name, item)
+        }
+    }
+}
+
+func EqualStrings(a []string, b []string) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for i := range a {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+    return true
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/url"
+    "strconv"
+    "time"
+    "github.com/flosch/pongo2"
+    "github.com/zenazn/goji/web"
+)
+
+const (
+    JSONFEED_VERSION  = "https://jsonfeed.org/version/1.1"
+    FEED_IMAGE_TYPE   = "image/jpeg"
+    FEED_TAG_FALLBACK = "colle"
+)
+
+// FeedEntry is an item with the values Atom and JSON Feed need. Id is a
+// tag URI, e.g. tag:example.com,2015-10-01:item/123, which stays the same
+// however often the item is rendered.
+type FeedEntry struct {
+    Item
+    EntryId   string
+    Url       string
+    Published string
+}
+
+type JsonFeed struct {
+    Version     string         `json:"version"`
+    Title       string         `json:"title"`
+    HomePageUrl string         `json:"home_page_url"`
+    FeedUrl     string         `json:"feed_url"`
+    Language    string         `json:"language"`
+    Items       []JsonFeedItem `json:"items"`
+}
+
+type JsonFeedItem struct {
+    Id            string               `json:"id"`
+    Url           string               `json:"url"`
+    ExternalUrl   string               `json:"external_url,omitempty"`
+    Title         string               `json:"title"`
+    ContentText   string               `json:"content_text"`
+    Image         string               `json:"image,omitempty"`
+    DatePublished string               `json:"date_published"`
+    Tags          []string             `json:"tags,omitempty"`
+    Authors       []JsonFeedAuthor     `json:"authors,omitempty"`
+    Attachments   []JsonFeedAttachment `json:"attachments,omitempty"`
+}
+
+type JsonFeedAuthor struct {
+    Name string `json:"name"`
+    Url  string `json:"url,omitempty"`
+}
+
+type JsonFeedAttachment struct {
+    Url      string `json:"url"`
+    MimeType string `json:"mime_type"`
+}
+
+func GetFeedEntries(userconf *UserConfig, items []Item) []FeedEntry {
+    host := FEED_TAG_FALLBACK
+    if u, err := url.Parse(userconf.Site.Url); err == nil && u.Host != "" {
+        host = u.Host
+    }
+    var result []FeedEntry
+    for _, item := range items {
+        result = append(result, FeedEntry{
+            Item:      item,
+            EntryId:   "tag:" + host + "," + item.PubDateTime.Format("2006-01-02") + ":item/" + strconv.Itoa(item.Id),
+            Url:       userconf.Site.Url + "/?id=" + strconv.Itoa(item.Id),
+            Published: item.PubDateTime.Format(time.RFC3339),
+        })
+    }
+    return result
+}
+
+// GetFeedUpdated returns the time of the newest entry, or now for an empty
+// feed.
+func GetFeedUpdated(entries []FeedEntry) string {
+    updated := time.Time{}
+    for _, entry := range entries {
+        if entry.PubDateTime.After(updated) {
+            updated = entry.PubDateTime
+        }
+    }
+    if updated.IsZero() {
+        updated = time.Now()
+    }
+    return updated.Format(time.RFC3339)
+}
+
+func GetFeedHomeUrl(userconf *UserConfig, category string) string {
+    if category != "" {
+        return userconf.Site.Url + "/" + category + "/"
+    }
+    return userconf.Site.Url + "/"
+}
+
+func NewJsonFeed(userconf *UserConfig, category string, entries []FeedEntry) JsonFeed {
+    feed := JsonFeed{
+        Version:     JSONFEED_VERSION,
+        Title:       userconf.Site.Title,
+        HomePageUrl: GetFeedHomeUrl(userconf, category),
+        FeedUrl:     GetFeedHomeUrl(userconf, category) + "feed.json",
+        Language:    "ja",
+        Items:       []JsonFeedItem{},
+    }
+    for _, entry := range entries {
+        item := JsonFeedItem{
+            Id:            entry.EntryId,
+            Url:           entry.Url,
+            ExternalUrl:   entry.Link,
+            Title:         entry.Title,
+            ContentText:   entry.Content,
+            Image:         entry.ImageLink,
+            DatePublished: entry.Published,
+        }
+        if entry.Category != "" {
+            item.Tags = []string{entry.Category}
+        }
+        if entry.FeedTitle != "" {
+            item.Authors = []JsonFeedAuthor{{entry.FeedTitle, entry.FeedLink}}
+        }
+        if entry.ImageLink != "" {
+            item.Attachments = []JsonFeedAttachment{{entry.ImageLink, FEED_IMAGE_TYPE}}
+        }
+        feed.Items = append(feed.Items, item)
+    }
+    return feed
+}
+
+func (cntr Controller) AtomFeed(c web.C, w http.ResponseWriter, r *http.Request) {
+    tpl, err := pongo2.FromFile("atom.j2")
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    category := c.URLParams["category"]
+    items := cntr.GetPageFeedItem(1, category, cntr.UserConfig.Site.ItemDays, cntr.UserConfig.Site.PageNewItemCount)
+    entries := GetFeedEntries(cntr.UserConfig, items)
+    w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+    tpl.ExecuteWriter(pongo2.Context{"entries": entries, "home": GetFeedHomeUrl(cntr.UserConfig, category), "updated": GetFeedUpdated(entries), "imagetype": FEED_IMAGE_TYPE}, w)
+}
+
+func (cntr Controller) JsonFeed(c web.C, w http.ResponseWriter, r *http.Request) {
+    category := c.URLParams["category"]
+    items := cntr.GetPageFeedItem(1, category, cntr.UserConfig.Site.ItemDays, cntr.UserConfig.Site.PageNewItemCount)
+    w.Header().Set("Content-Type", "application/feed+json; charset=utf-8")
+    json.NewEncoder(w).Encode(NewJsonFeed(cntr.UserConfig, category, GetFeedEntries(cntr.UserConfig, items)))
+}
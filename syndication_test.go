@@ -0,0 +1,87 @@
+package main
+
+import (
+    "encoding/json"
+    "encoding/xml"
+    "net/http"
+    "strings"
+    "testing"
+    "time"
+)
+
+type testAtomFeed struct {
+    XMLName xml.Name `xml:"http://www.w3.org/2005/Atom feed"`
+    Id      string   `xml:"id"`
+    Title   string   `xml:"title"`
+    Updated string   `xml:"updated"`
+    Entries []struct {
+        Id        string `xml:"id"`
+        Title     string `xml:"title"`
+        Published string `xml:"published"`
+    } `xml:"entry"`
+}
+
+func TestAtomFeed(t *testing.T) {
+    cntr := NewTestController(t, "Tokyo stocks rise", "Rain & snow <expected>")
+    for _, params := range []map[string]string{nil, {"category": "news"}} {
+        w := ServeTest(cntr.AtomFeed, "GET", "/feed.atom", params)
+        if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "application/atom+xml") {
+            t.Fatalf("%v: status %d, content type %q", params, w.Code, w.Header().Get("Content-Type"))
+        }
+        var feed testAtomFeed
+        if err := xml.Unmarshal(w.Body.Bytes(), &feed); err != nil {
+            t.Fatalf("%v: %s\n%s", params, err.Error(), w.Body.String())
+        }
+        if feed.Id == "" || feed.Title != "colle" {
+            t.Errorf("%v: feed id %q, title %q", params, feed.Id, feed.Title)
+        }
+        if _, err := time.Parse(time.RFC3339, feed.Updated); err != nil {
+            t.Errorf("%v: feed updated %q: %s", params, feed.Updated, err.Error())
+        }
+        if len(feed.Entries) != 2 {
+            t.Fatalf("%v: %d entries, want 2", params, len(feed.Entries))
+        }
+        if feed.Entries[0].Title != "Rain & snow <expected>" {
+            t.Errorf("%v: entry title %q", params, feed.Entries[0].Title)
+        }
+        seen := make(map[string]bool)
+        for _, entry := range feed.Entries {
+            if !strings.HasPrefix(entry.Id, "tag:example.com,") || seen[entry.Id] {
+                t.Errorf("%v: entry id %q", params, entry.Id)
+            }
+            seen[entry.Id] = true
+            if _, err := time.Parse(time.RFC3339, entry.Published); err != nil {
+                t.Errorf("%v: entry published %q: %s", params, entry.Published, err.Error())
+            }
+        }
+    }
+}
+
+func TestJsonFeed(t *testing.T) {
+    cntr := NewTestController(t, "Tokyo stocks rise", "Rain expected in Osaka")
+    for _, params := range []map[string]string{nil, {"category": "news"}} {
+        w := ServeTest(cntr.JsonFeed, "GET", "/feed.json", params)
+        if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "application/feed+json") {
+            t.Fatalf("%v: status %d, content type %q", params, w.Code, w.Header().Get("Content-Type"))
+        }
+        var feed map[string]interface{}
+        if err := json.Unmarshal(w.Body.Bytes(), &feed); err != nil {
+            t.Fatalf("%v: %s", params, err.Error())
+        }
+        if feed["version"] != JSONFEED_VERSION || feed["title"] != "colle" {
+            t.Errorf("%v: version %v, title %v", params, feed["version"], feed["title"])
+        }
+        items, ok := feed["items"].([]interface{})
+        if !ok || len(items) != 2 {
+            t.Fatalf("%v: items %v", params, feed["items"])
+        }
+        seen := make(map[string]bool)
+        for _, v := range items {
+            id, _ := v.(map[string]interface{})["id"].(string)
+            if id == "" || seen[id] {
+                t.Errorf("%v: item id %q", params, id)
+            }
+            seen[id] = true
+        }
+    }
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+    "math"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "unicode/utf8"
+    "github.com/flosch/pongo2"
+    "github.com/zenazn/goji/web"
+)
+
+const (
+    DICT_SCORE_LENGTH     = "length"
+    DICT_SCORE_POSITION   = "position"
+    DICT_SCORE_ADVERTISER = "advertiser"
+    SEARCH_TAG_PREFIX     = "tag:"
+)
+
+var DEFAULT_DICT_SCORE_RULES = []string{DICT_SCORE_LENGTH, DICT_SCORE_POSITION, DICT_SCORE_ADVERTISER}
+
+// DictMatch is a dictionary word found in the title of an entry.
+type DictMatch struct {
+    Word     string
+    Position int
+    Detail   DictItemRedis
+}
+
+// GetDictMatches returns the dictionary words in title, each once, the
+// primary one first by dict.score.
+func (dm *DataManager) GetDictMatches(title string, matcher *Matcher) []DictMatch {
+    var result []DictMatch
+    seen := make(map[string]bool)
+    for _, match := range matcher.Match(title) {
+        if seen[match.Word] {
+            continue
+        }
+        seen[match.Word] = true
+        result = append(result, DictMatch{
+            Word:     match.Word,
+            Position: utf8.RuneCountInString(title[:match.Start]),
+            Detail:   dm.GetDictDetail(REDISKEY_DICT_ITEM_PREFIX + match.Word),
+        })
+    }
+    SortDictMatches(result, dm.UserConfig.Dict.Score)
+    return result
+}
+
+// SortDictMatches orders matches by the rules of dict.score in turn:
+// longer words, words earlier in the title and advertisers earlier in
+// dict.score.advertisers come first.
+func SortDictMatches(matches []DictMatch, conf ConfigDictScore) {
+    rules := conf.Rules
+    if len(rules) == 0 {
+        rules = DEFAULT_DICT_SCORE_RULES
+    }
+    sort.Stable(byDictScore{matches, rules, conf.Advertisers})
+}
+
+type byDictScore struct {
+    matches     []DictMatch
+    rules       []string
+    advertisers []string
+}
+
+func (a byDictScore) Len() int      { return len(a.matches) }
+func (a byDictScore) Swap(i, j int) { a.matches[i], a.matches[j] = a.matches[j], a.matches[i] }
+func (a byDictScore) Less(i, j int) bool {
+    x, y := a.matches[i], a.matches[j]
+    for _, rule := range a.rules {
+        switch rule {
+            case DICT_SCORE_LENGTH:
+                if lx, ly := utf8.RuneCountInString(x.Word), utf8.RuneCountInString(y.Word); lx != ly {
+                    return lx > ly
+                }
+            case DICT_SCORE_POSITION:
+                if x.Position != y.Position {
+                    return x.Position < y.Position
+                }
+            case DICT_SCORE_ADVERTISER:
+                if px, py := a.priority(x.Detail.Advertiser), a.priority(y.Detail.Advertiser); px != py {
+                    return px < py
+                }
+        }
+    }
+    return false
+}
+
+// priority ranks advertisers in the order of dict.score.advertisers, the
+// ones not listed last.
+func (a byDictScore) priority(advertiser string) int {
+    for i, v := range a.advertisers {
+        if v == advertiser {
+            return i
+        }
+    }
+    return len(a.advertisers)
+}
+
+// SetDictMatches sets the matched words of item and the affiliate data of
+// the primary one.
+func SetDictMatches(item *ItemRedis, matches []DictMatch) {
+    var words []string
+    for _, match := range matches {
+        words = append(words, match.Word)
+    }
+    primary := matches[0]
+    item.MatchingWord    = primary.Word
+    item.MatchingWords   = strings.Join(words, "\n")
+    item.AffiliateURL    = primary.Detail.AffiliateURL
+    item.AffiliateItemId = primary.Detail.AffiliateItemId
+    item.ListImage       = primary.Detail.ListImage
+    item.Images          = primary.Detail.Images
+}
+
+// GetItemTags returns the matched words of an item. Items stored before
+// multiple matches only have MatchingWord.
+func GetItemTags(i ItemRedis) []string {
+    if i.MatchingWords != "" {
+        return strings.Split(i.MatchingWords, "\n")
+    }
+    if i.MatchingWord != "" {
+        return []string{i.MatchingWord}
+    }
+    return nil
+}
+
+// GetTagTokens returns the search tokens of the tags of an item. Tags are
+// kept in the search index so tag pages are dropped with it on expiry.
+func GetTagTokens(i ItemRedis) []string {
+    var result []string
+    for _, tag := range GetItemTags(i) {
+        result = append(result, SEARCH_TAG_PREFIX + tag)
+    }
+    return result
+}
+
+func (dm *DataManager) GetTagItem(tag string, offset int, count int) []Item {
+    index := REDISKEY_SEARCH_TOKEN_PREFIX + SEARCH_TAG_PREFIX + tag
+    return dm.GetItems(dm.Store.SearchItems([]string{index}, math.Inf(-1), math.Inf(1), offset, count))
+}
+
+func (cntr Controller) Tag(c web.C, w http.ResponseWriter, r *http.Request) {
+    tpl, err := pongo2.FromFile("main.j2")
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    pagenum, err := strconv.Atoi(r.URL.Query().Get("p"))
+    if err != nil || pagenum < 1 {
+        pagenum = 1;
+    }
+    tag := c.URLParams["tag"]
+    count := cntr.UserConfig.Site.PageNewItemCount
+    items := cntr.GetTagItem(tag, (pagenum - 1) * count, count)
+    tpl.ExecuteWriter(pongo2.Context{"items": items, "p": pagenum, "tag": tag, "windows": RANK_WINDOWS, "token": cntr.Filter.GetTokenFunc(r)}, w)
+}